@@ -3,6 +3,9 @@ package imagestore_test
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,9 +13,12 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
 	"github.com/mistifyio/go-zfs"
 	imagestore "github.com/mistifyio/mistify-agent-image"
 	rpc "github.com/mistifyio/mistify-agent/rpc"
@@ -20,6 +26,7 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
 	"github.com/tylerb/graceful"
+	"github.com/ulikunitz/xz"
 )
 
 type APITestSuite struct {
@@ -35,6 +42,16 @@ type APITestSuite struct {
 	ImageService *httptest.Server
 	ImageID      string
 	ImageData    []byte
+	SigningKey   ed25519.PrivateKey
+	// number of downloads resumed with a range request, updated atomically
+	// by the fake image service
+	ResumedDownloads int32
+	// number of requests for the image that fails the first time, updated
+	// atomically by the fake image service
+	FlakyRequests int32
+	// Configure changes the store config of a suite, after the fake image
+	// service is set up
+	Configure func(*imagestore.Config)
 }
 
 func (s *APITestSuite) SetupSuite() {
@@ -44,6 +61,9 @@ func (s *APITestSuite) SetupSuite() {
 	s.Port = 54321
 	s.Client, _ = rpc.NewClient(uint(s.Port), "")
 
+	// Set up a key to sign images with
+	_, s.SigningKey, _ = ed25519.GenerateKey(rand.Reader)
+
 	// Set up a fake ImageService to fetch images from
 	s.ImageService = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == fmt.Sprintf("/images/%s/download", s.ImageID) {
@@ -53,6 +73,64 @@ func (s *APITestSuite) SetupSuite() {
 			return
 		}
 
+		if r.URL.Path == fmt.Sprintf("/images/%s/checksum", s.ImageID) {
+			fmt.Fprintf(w, "%x  %s\n", sha256.Sum256(s.ImageData), s.ImageID)
+			return
+		}
+
+		if r.URL.Path == fmt.Sprintf("/images/%s/signature", s.ImageID) {
+			digest := sha256.Sum256(s.ImageData)
+			if _, err := w.Write(ed25519.Sign(s.SigningKey, digest[:])); err != nil {
+				log.WithField("error", err).Error("Failed to write mock signature to response")
+			}
+			return
+		}
+
+		if r.URL.Path == "/images/badChecksumID/download" {
+			w.Header().Set("X-Image-Checksum", fmt.Sprintf("sha256:%064x", 0))
+			if _, err := w.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+
+		if r.URL.Path == "/images/resumeID/download" {
+			w.Header().Set("ETag", `"resumeID"`)
+			if r.Header.Get("Range") == "" {
+				// Send only part of the image, which drops the connection
+				w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+				if _, err := w.Write(s.ImageData[:len(s.ImageData)/2]); err != nil {
+					log.WithField("error", err).Error("Failed to write mock image data to response")
+				}
+				return
+			}
+			atomic.AddInt32(&s.ResumedDownloads, 1)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.ImageData))
+			return
+		}
+
+		if r.URL.Path == "/images/flakyID/download" {
+			if atomic.AddInt32(&s.FlakyRequests, 1) == 1 {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if _, err := w.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+
+		if r.URL.Path == "/images/slowID/download" {
+			// Send part of the image and stall until the client gives up
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+			if _, err := w.Write(s.ImageData[:len(s.ImageData)/2]); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+
 		if r.URL.Path == "/images/gzipID/download" {
 			gzipWriter := gzip.NewWriter(w)
 			defer logx.LogReturnedErr(gzipWriter.Close, nil, "failed to close gzip writer")
@@ -62,11 +140,42 @@ func (s *APITestSuite) SetupSuite() {
 			return
 		}
 
+		if r.URL.Path == "/images/xzID/download" {
+			xzWriter, err := xz.NewWriter(w)
+			if err != nil {
+				log.WithField("error", err).Error("Failed to create xz writer")
+				return
+			}
+			defer logx.LogReturnedErr(xzWriter.Close, nil, "failed to close xz writer")
+			if _, err := xzWriter.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+
+		if r.URL.Path == "/images/zstdID/download" {
+			zstdWriter, err := zstd.NewWriter(w)
+			if err != nil {
+				log.WithField("error", err).Error("Failed to create zstd writer")
+				return
+			}
+			defer logx.LogReturnedErr(zstdWriter.Close, nil, "failed to close zstd writer")
+			if _, err := zstdWriter.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+
 		http.NotFound(w, r)
 		return
 	}))
 	imageURL, _ := url.Parse(s.ImageService.URL)
 	s.StoreConfig.ImageServer = imageURL.Host
+	s.StoreConfig.Retry.InitialBackoff = 10 * time.Millisecond
+
+	if s.Configure != nil {
+		s.Configure(&s.StoreConfig)
+	}
 }
 
 func (s *APITestSuite) SetupTest() {
@@ -78,23 +187,7 @@ func (s *APITestSuite) SetupTest() {
 	// Create a zpool
 	s.ID = "mist-" + uuid.New()
 	s.StoreConfig.Zpool = s.ID
-	s.ZpoolDir, err = ioutil.TempDir("", "APITestSuite-"+s.ID)
-	require.NoError(err, "creating tempdir")
-	zpoolFileNames := make([]string, 3)
-	for i := range zpoolFileNames {
-		file, err := ioutil.TempFile(s.ZpoolDir, "zfs-")
-		require.NoError(err, "creating tempfile")
-		defer logx.LogReturnedErr(file.Close, log.Fields{
-			"filename": file.Name(),
-		}, "failed to close tempfile")
-		require.NoError(file.Truncate(int64(8e7)), "truncate file") // 80MB file
-		zpoolFileNames[i] = file.Name()
-		defer logx.LogReturnedErr(func() error { return os.Remove(file.Name()) },
-			log.Fields{"filename": file.Name()},
-			"failed to remove tempfile")
-	}
-	s.Zpool, err = zfs.CreateZpool(s.ID, nil, zpoolFileNames...)
-	require.NoError(err, "create zpool")
+	s.Zpool, s.ZpoolDir = s.createZpool(s.ID)
 
 	// Set up the image to be served from the test "image service" by creating
 	// a volume, exporting a snapshot, and cleaning up. Only needs to be done
@@ -118,6 +211,31 @@ func (s *APITestSuite) SetupTest() {
 	s.Server = s.Store.RunHTTP(uint(s.Port))
 }
 
+// createZpool creates a zpool backed by files in a new tempdir, and returns
+// the zpool and the tempdir
+func (s *APITestSuite) createZpool(id string) (*zfs.Zpool, string) {
+	require := s.Require()
+
+	dir, err := ioutil.TempDir("", "APITestSuite-"+id)
+	require.NoError(err, "creating tempdir")
+	zpoolFileNames := make([]string, 3)
+	for i := range zpoolFileNames {
+		file, err := ioutil.TempFile(dir, "zfs-")
+		require.NoError(err, "creating tempfile")
+		defer logx.LogReturnedErr(file.Close, log.Fields{
+			"filename": file.Name(),
+		}, "failed to close tempfile")
+		require.NoError(file.Truncate(int64(8e7)), "truncate file") // 80MB file
+		zpoolFileNames[i] = file.Name()
+		defer logx.LogReturnedErr(func() error { return os.Remove(file.Name()) },
+			log.Fields{"filename": file.Name()},
+			"failed to remove tempfile")
+	}
+	zpool, err := zfs.CreateZpool(id, nil, zpoolFileNames...)
+	require.NoError(err, "create zpool")
+	return zpool, dir
+}
+
 func (s *APITestSuite) TearDownTest() {
 	// Stop the image store
 	stopChan := s.Server.StopChan()
@@ -142,6 +260,24 @@ func (s *APITestSuite) fetchImage() *rpc.Image {
 	return response.Images[0]
 }
 
+// waitForImage polls an image until it is no longer being fetched
+func (s *APITestSuite) waitForImage(id string) *imagestore.Image {
+	request := &rpc.ImageRequest{ID: id}
+	for i := 0; i < 100; i++ {
+		response := &imagestore.ImageResponse{}
+		if err := s.Client.Do("ImageStore.GetImage", request, response); err == nil {
+			switch response.Images[0].Status {
+			case imagestore.ImageStatusPending, imagestore.ImageStatusDownloading, imagestore.ImageStatusImporting:
+			default:
+				return response.Images[0]
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Fail("timed out waiting for image " + id)
+	return nil
+}
+
 func init() {
 	// Try to catch zfs permission errors before running any tests
 	if _, err := zfs.ListZpools(); err != nil {
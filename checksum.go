@@ -0,0 +1,131 @@
+package imagestore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+const (
+	// checksumHeader is the response header an image server may use to
+	// advertise the expected digest of an image download
+	checksumHeader = "X-Image-Checksum"
+	// checksumPrefix is prepended to hex digests stored on image records
+	checksumPrefix = "sha256:"
+)
+
+// ErrorChecksum should be used for errors resulting from a downloaded image
+// not matching its expected digest
+type ErrorChecksum struct {
+	Expected string
+	Actual   string
+	Source   string
+}
+
+// Error returns a string error message
+func (e ErrorChecksum) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, received %s, url: %s", e.Expected, e.Actual, e.Source)
+}
+
+// parseChecksum normalizes a sha256 digest. It accepts a bare hex digest, one
+// prefixed with "sha256:" or "sha256=", and the output format of sha256sum.
+func parseChecksum(value string) (string, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	digest := strings.ToLower(fields[0])
+	for _, prefix := range []string{checksumPrefix, "sha256="} {
+		digest = strings.TrimPrefix(digest, prefix)
+	}
+
+	if len(digest) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256 checksum: %s", value)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", fmt.Errorf("invalid sha256 checksum: %s", value)
+	}
+	return checksumPrefix + digest, nil
+}
+
+// fetchChecksum retrieves the expected digest from a checksum file. A missing
+// checksum file is not an error and results in an empty checksum.
+func (f *fetcher) fetchChecksum(location string) (string, error) {
+	if location == "" {
+		return "", nil
+	}
+
+	// A checksum file is a single line; don't read more than that
+	data, err := f.readSmall(location, 1024)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	line, _ := bufio.NewReader(bytes.NewReader(data)).ReadString('\n')
+	return parseChecksum(line)
+}
+
+// expectedChecksum determines the digest an image download should match,
+// preferring one provided along with the download over the checksum file.
+// Peers serve send streams, which are never the same as what the image
+// servers serve, so they have to provide the digest of the stream.
+func (f *fetcher) expectedChecksum(req *fetchRequest, inband string) (string, error) {
+	if inband != "" {
+		return parseChecksum(inband)
+	}
+	expected, err := f.fetchChecksum(req.checksumSource)
+	if err == nil && expected == "" && req.peer {
+		return "", ErrNoPeerChecksum
+	}
+	return expected, err
+}
+
+// verifyChecksum compares a computed digest against the expected one, and
+// records on the request whether the image was verified. An empty expected
+// digest means the source didn't provide one.
+func verifyChecksum(req *fetchRequest, expected, actual string) error {
+	req.verified = false
+	if expected == "" {
+		log.WithFields(log.Fields{
+			"image":    req.name,
+			"checksum": actual,
+		}).Warning("no checksum available to verify image against")
+		return nil
+	}
+	if expected != actual {
+		return ErrorChecksum{
+			Expected: expected,
+			Actual:   actual,
+			Source:   req.source,
+		}
+	}
+	req.verified = true
+	return nil
+}
+
+// fileChecksum computes the digest of a file on disk
+func fileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"filename": filename,
+	}, "failed to close file")
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return checksumPrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -6,9 +6,31 @@ Usage
 The following arguments are understood:
 
 	Usage of ./mistify-agent-image:
-	-i, --image-service="image.services.lochness.local": image service. srv query used to find port if not specified
+	    --bandwidth-limit=0: bytes per second for all image downloads, 0 for unlimited
+	    --basic-auth="": user:password sent to http image sources
+	    --bearer-token="": bearer token sent to http image sources
+	    --ca-cert="": pem bundle of additional certificate authorities to trust for https image sources
+	    --cache-size=0: bytes images may use before least recently used ones are garbage collected, 0 for unlimited
+	    --client-cert="": pem client certificate for https image sources
+	    --client-key="": pem key for the client certificate
+	    --connect-timeout=30s: timeout for connecting to an image source and receiving its response headers
+	    --download-timeout=0: timeout for an entire image download, 0 for none
+	    --fetch-bandwidth-limit=0: bytes per second for each image download, 0 for unlimited
+	    --gc-interval=5m0s: how often images are garbage collected when a cache size is set
+	-i, --image-service=[image.services.lochness.local]: image services, tried in order. srv query used to find ports if not specified. prefix with https:// to use tls
+	    --import-mode="staged": how images are imported: staged downloads to disk first so downloads can be resumed, stream receives images as they are downloaded
 	-l, --log-level="warning": log level: debug/info/warning/error/critical/fatal
+	    --max-pending=0: image fetches that may wait to start before more are turned away, 0 for unlimited
+	    --migration-timeout=12h0m0s: timeout for sending a guest disk to a peer agent
+	    --peer=[]: peer agents to fetch images from before the image services, in the same forms. not used with a trust store
 	-p, --port=19999: listen port
+	    --queue-wait=0: how long an image fetch waits for room when max-pending are waiting before it's turned away
+	    --reconcile-interval=1h0m0s: how often image records are reconciled with the datasets on disk, in addition to at startup
+	    --s3-endpoint="": s3 compatible endpoint for s3:// image sources. credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	    --s3-region="us-east-1": region for s3:// image sources
+	-s, --source=[]: named image source as name=url, where {id} in the url is replaced with the image id
+	    --source-prefix=[]: url prefix image requests may give sources under in full, e.g. file:///mnt/images/
+	-t, --trust-store="": directory of public keys images must be signed with
 	-z, --zpool="mistify": zpool
 */
 package main
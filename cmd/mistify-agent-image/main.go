@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	imagestore "github.com/mistifyio/mistify-agent-image"
@@ -10,13 +13,41 @@ import (
 )
 
 func main() {
-	var zpool, imageService, logLevel string
-	var port uint
+	var zpool, logLevel, trustStore, s3Endpoint, s3Region string
+	var caCert, clientCert, clientKey, bearerToken, basicAuth, importMode string
+	var imageServices, peers, sourcePrefixes []string
+	var port, maxPending uint
+	var sources map[string]string
+	var connectTimeout, downloadTimeout, migrationTimeout, queueWait, gcInterval, reconcileInterval time.Duration
+	var cacheSize uint64
+	var bandwidthLimit, fetchBandwidthLimit int64
 
 	flag.UintVarP(&port, "port", "p", 19999, "listen port")
 	flag.StringVarP(&zpool, "zpool", "z", "mistify", "zpool")
 	flag.StringVarP(&logLevel, "log-level", "l", "warning", "log level: debug/info/warning/error/critical/fatal")
-	flag.StringVarP(&imageService, "image-service", "i", "image.services.lochness.local", "image service. srv query used to find port if not specified")
+	flag.StringSliceVarP(&imageServices, "image-service", "i", []string{"image.services.lochness.local"}, "image services, tried in order. srv query used to find ports if not specified. prefix with https:// to use tls")
+	flag.UintVar(&maxPending, "max-pending", 0, "image fetches that may wait to start before more are turned away, 0 for unlimited")
+	flag.DurationVar(&queueWait, "queue-wait", 0, "how long an image fetch waits for room when max-pending are waiting before it's turned away")
+	flag.StringSliceVar(&peers, "peer", nil, "peer agents to fetch images from before the image services, in the same forms. not used with a trust store")
+	flag.StringVarP(&trustStore, "trust-store", "t", "", "directory of public keys images must be signed with")
+	flag.StringToStringVarP(&sources, "source", "s", nil, "named image source as name=url, where {id} in the url is replaced with the image id")
+	flag.StringSliceVar(&sourcePrefixes, "source-prefix", nil, "url prefix image requests may give sources under in full, e.g. file:///mnt/images/")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "s3 compatible endpoint for s3:// image sources. credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "region for s3:// image sources")
+	flag.StringVar(&caCert, "ca-cert", "", "pem bundle of additional certificate authorities to trust for https image sources")
+	flag.StringVar(&clientCert, "client-cert", "", "pem client certificate for https image sources")
+	flag.StringVar(&clientKey, "client-key", "", "pem key for the client certificate")
+	flag.StringVar(&bearerToken, "bearer-token", "", "bearer token sent to http image sources")
+	flag.StringVar(&basicAuth, "basic-auth", "", "user:password sent to http image sources")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 30*time.Second, "timeout for connecting to an image source and receiving its response headers")
+	flag.DurationVar(&downloadTimeout, "download-timeout", 0, "timeout for an entire image download, 0 for none")
+	flag.DurationVar(&migrationTimeout, "migration-timeout", 12*time.Hour, "timeout for sending a guest disk to a peer agent")
+	flag.Int64Var(&bandwidthLimit, "bandwidth-limit", 0, "bytes per second for all image downloads, 0 for unlimited")
+	flag.Int64Var(&fetchBandwidthLimit, "fetch-bandwidth-limit", 0, "bytes per second for each image download, 0 for unlimited")
+	flag.Uint64Var(&cacheSize, "cache-size", 0, "bytes images may use before least recently used ones are garbage collected, 0 for unlimited")
+	flag.DurationVar(&gcInterval, "gc-interval", 5*time.Minute, "how often images are garbage collected when a cache size is set")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", time.Hour, "how often image records are reconciled with the datasets on disk, in addition to at startup")
+	flag.StringVar(&importMode, "import-mode", imagestore.ImportModeStaged, "how images are imported: staged downloads to disk first so downloads can be resumed, stream receives images as they are downloaded")
 	flag.Parse()
 
 	if err := logx.DefaultSetup(logLevel); err != nil {
@@ -26,9 +57,43 @@ func main() {
 		}).Fatal("failed to set up logrus")
 	}
 
+	httpConfig := imagestore.HTTPConfig{
+		CACert:           caCert,
+		ClientCert:       clientCert,
+		ClientKey:        clientKey,
+		BearerToken:      bearerToken,
+		ConnectTimeout:   connectTimeout,
+		DownloadTimeout:  downloadTimeout,
+		MigrationTimeout: migrationTimeout,
+	}
+	if basicAuth != "" {
+		parts := strings.SplitN(basicAuth, ":", 2)
+		httpConfig.BasicAuthUser = parts[0]
+		if len(parts) == 2 {
+			httpConfig.BasicAuthPassword = parts[1]
+		}
+	}
+
 	store, err := imagestore.Create(imagestore.Config{
-		ImageServer: imageService,
-		Zpool:       zpool,
+		ImageServers:        imageServices,
+		Zpool:               zpool,
+		TrustStore:          trustStore,
+		Sources:             sources,
+		SourcePrefixes:      sourcePrefixes,
+		S3Endpoint:          s3Endpoint,
+		S3Region:            s3Region,
+		S3AccessKey:         os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3SecretKey:         os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		HTTP:                httpConfig,
+		BandwidthLimit:      bandwidthLimit,
+		FetchBandwidthLimit: fetchBandwidthLimit,
+		ImportMode:          importMode,
+		Peers:               peers,
+		MaxPending:          maxPending,
+		QueueWait:           queueWait,
+		CacheSize:           cacheSize,
+		GCInterval:          gcInterval,
+		ReconcileInterval:   reconcileInterval,
 	})
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -0,0 +1,178 @@
+package imagestore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats of image streams
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+	CompressionLz4   = "lz4"
+)
+
+// compressionMagic identifies compression formats by their first bytes
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionLz4, []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// compressionNames maps content encodings, content types and file extensions
+// to compression formats
+var compressionNames = map[string]string{
+	"gzip":                CompressionGzip,
+	"x-gzip":              CompressionGzip,
+	"application/gzip":    CompressionGzip,
+	"application/x-gzip":  CompressionGzip,
+	".gz":                 CompressionGzip,
+	"xz":                  CompressionXz,
+	"application/x-xz":    CompressionXz,
+	".xz":                 CompressionXz,
+	"zstd":                CompressionZstd,
+	"application/zstd":    CompressionZstd,
+	".zst":                CompressionZstd,
+	"bzip2":               CompressionBzip2,
+	"x-bzip2":             CompressionBzip2,
+	"application/x-bzip2": CompressionBzip2,
+	".bz2":                CompressionBzip2,
+	"lz4":                 CompressionLz4,
+	"application/x-lz4":   CompressionLz4,
+	".lz4":                CompressionLz4,
+}
+
+// compressionHint returns the compression format an http response claims its
+// body has, if any
+func compressionHint(header http.Header) string {
+	if format, ok := compressionNames[strings.ToLower(header.Get("Content-Encoding"))]; ok {
+		return format
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil {
+		return compressionNames[mediaType]
+	}
+	return ""
+}
+
+// compressionFromName returns the compression format implied by a file name's
+// extension, if any
+func compressionFromName(name string) string {
+	return compressionNames[strings.ToLower(path.Ext(name))]
+}
+
+// sourceCompression returns the compression format a source claims a file
+// has, or failing that what its name implies
+func sourceCompression(location string, file *sourceFile) string {
+	if file.compression != "" {
+		return file.compression
+	}
+	if u, err := url.Parse(location); err == nil {
+		return compressionFromName(u.Path)
+	}
+	return ""
+}
+
+// detectCompression identifies the compression format of an image from its
+// first bytes, falling back to the hint from the source
+func detectCompression(header []byte, hint string) string {
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(header, c.magic) {
+			return c.format
+		}
+	}
+	if hint != "" {
+		return hint
+	}
+	return CompressionNone
+}
+
+// decompress uncompresses an image, returning the reader and the compression
+// format detected
+func decompress(reader io.Reader, hint string) (io.ReadCloser, string, error) {
+	// Use a buffer so the first few bytes can be peeked at for file type
+	// detection
+	buffer := bufio.NewReader(reader)
+
+	header, err := buffer.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	format := detectCompression(header, hint)
+	var decompressed io.ReadCloser
+	switch format {
+	case CompressionNone:
+		decompressed = ioutil.NopCloser(buffer)
+	case CompressionGzip:
+		decompressed, err = gzip.NewReader(buffer)
+	case CompressionXz:
+		var xzReader *xz.Reader
+		xzReader, err = xz.NewReader(buffer)
+		decompressed = ioutil.NopCloser(xzReader)
+	case CompressionZstd:
+		var zstdDecoder *zstd.Decoder
+		zstdDecoder, err = zstd.NewReader(buffer)
+		if err == nil {
+			decompressed = zstdDecoder.IOReadCloser()
+		}
+	case CompressionBzip2:
+		decompressed = ioutil.NopCloser(bzip2.NewReader(buffer))
+	case CompressionLz4:
+		decompressed = ioutil.NopCloser(lz4.NewReader(buffer))
+	default:
+		err = fmt.Errorf("unsupported compression format %s", format)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return decompressed, format, nil
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressor compresses what is written to it in a compression format. It
+// must be closed to flush the compressed data.
+func compressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionXz:
+		return xz.NewWriter(w)
+	}
+	return nil, errors.New("unsupported compression " + compression)
+}
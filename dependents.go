@@ -0,0 +1,125 @@
+package imagestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+type (
+	// DeleteImageRequest is the request for DeleteImage. It is compatible
+	// with rpc.ImageRequest.
+	DeleteImageRequest struct {
+		rpc.ImageRequest
+		// Destroy guest disks and other clones of the image along with it
+		Force bool `json:"force"`
+		// Promote clones of the image so they no longer depend on it
+		Promote bool `json:"promote"`
+	}
+
+	// DeleteImageResponse is the response for DeleteImage. It is compatible
+	// with ImageResponse.
+	DeleteImageResponse struct {
+		ImageResponse
+		// Clones that keep the image from being deleted, along with an
+		// ErrorInUse
+		Dependents []string `json:"dependents,omitempty"`
+	}
+
+	// ImageDependentsResponse is the response for GetImageDependents
+	ImageDependentsResponse struct {
+		ID         string   `json:"id"`
+		Dependents []string `json:"dependents"` // clones of the image
+	}
+
+	// ErrorInUse should be used for errors resulting from deleting an image
+	// that clones still depend on
+	ErrorInUse struct {
+		ID         string
+		Dependents []string
+	}
+)
+
+// Error returns a string error message
+func (e ErrorInUse) Error() string {
+	return fmt.Sprintf("image %s in use by: %s", e.ID, strings.Join(e.Dependents, ", "))
+}
+
+// imageDependents lists the datasets cloned from the snapshot of an image,
+// such as guest disks and clones made by CloneImage, by their origin
+func (store *ImageStore) imageDependents(image *Image) ([]string, error) {
+	if image.Snapshot == "" {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	if err := zfsCommand(nil, &out, "list", "-H", "-o", "name,origin", "-t", "filesystem,volume", "-r", store.config.Zpool); err != nil {
+		return nil, err
+	}
+	dependents := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 && fields[1] == image.Snapshot {
+			dependents = append(dependents, fields[0])
+		}
+	}
+	sort.Strings(dependents)
+	return dependents, nil
+}
+
+// releaseDependents frees an image of its clones so it can be destroyed, by
+// promoting or destroying them as requested
+func (store *ImageStore) releaseDependents(image *Image, request *DeleteImageRequest) error {
+	if request.Force && request.Promote {
+		return errors.New("force and promote are mutually exclusive")
+	}
+	dependents, err := store.imageDependents(image)
+	if err != nil || len(dependents) == 0 {
+		return err
+	}
+
+	switch {
+	case request.Promote:
+		// Promoting a clone moves the image snapshot to it, along with the
+		// rest of the clones, so the image volume has to be destroyed on its
+		// own afterwards
+		if err := zfsCommand(nil, nil, "promote", dependents[0]); err != nil {
+			return err
+		}
+	case request.Force:
+		for _, name := range dependents {
+			if err := zfsCommand(nil, nil, "destroy", "-R", name); err != nil && !isZfsNotFound(err) {
+				return err
+			}
+		}
+	default:
+		return ErrorInUse{
+			ID:         image.ID,
+			Dependents: dependents,
+		}
+	}
+	return nil
+}
+
+// GetImageDependents lists the guest disks and other clones of an image, which
+// keep it from being deleted
+func (store *ImageStore) GetImageDependents(r *http.Request, request *rpc.ImageRequest, response *ImageDependentsResponse) error {
+	image, err := store.getImage(request.ID)
+	if err != nil {
+		return err
+	}
+	dependents, err := store.imageDependents(image)
+	if err != nil {
+		return err
+	}
+
+	*response = ImageDependentsResponse{
+		ID:         image.ID,
+		Dependents: dependents,
+	}
+	return nil
+}
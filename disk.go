@@ -0,0 +1,270 @@
+package imagestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/go-zfs"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// Disk formats of images. Images are zfs send streams or qcow2 disks when they
+// are recognized as such. Anything else is only taken as a raw disk when the
+// request or the name of the source says it is raw, or its checksum was
+// verified, so error pages and other garbage aren't imported.
+const (
+	DiskFormatZfs   = "zfs"
+	DiskFormatRaw   = "raw"
+	DiskFormatQcow2 = "qcow2"
+)
+
+const (
+	// zfsStreamMagic is found at offset 8 of the begin record of a zfs send
+	// stream, in the byte order of the sending machine
+	zfsStreamMagic = 0x2f5bacbac
+
+	// diskChunk is how much of a raw disk is written at once. Chunks of zeros
+	// are skipped so the zvol stays sparse.
+	diskChunk = 1024 * 1024
+
+	// zvolWait is how long to wait for the device of a new zvol to appear
+	zvolWait = 10 * time.Second
+)
+
+// ErrUnknownFormat is an error when an image isn't a recognized format and
+// can't be trusted to be a raw disk
+var ErrUnknownFormat = errors.New("unrecognized image format, raw disks need a raw format hint or a verified checksum")
+
+// rawNames are file extensions of raw disks
+var rawNames = map[string]bool{
+	".raw": true,
+	".img": true,
+}
+
+// detectDiskFormat identifies the format of a decompressed image from its
+// first bytes, or returns an empty string if it isn't recognized
+func detectDiskFormat(header []byte) string {
+	if bytes.HasPrefix(header, []byte(qcow2Magic)) {
+		return DiskFormatQcow2
+	}
+	if len(header) >= 16 {
+		magic := header[8:16]
+		if binary.LittleEndian.Uint64(magic) == zfsStreamMagic || binary.BigEndian.Uint64(magic) == zfsStreamMagic {
+			return DiskFormatZfs
+		}
+	}
+	return ""
+}
+
+// formatFromName returns the disk format the name of a source implies, after
+// any compression extension
+func formatFromName(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+	name := u.Path
+	if compressionFromName(name) != "" {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if rawNames[strings.ToLower(path.Ext(name))] {
+		return DiskFormatRaw
+	}
+	return ""
+}
+
+// diskFormat determines the format of an image being imported. Images that
+// aren't recognized are raw disks only if the request or source says so or the
+// image was verified against a checksum.
+func diskFormat(req *fetchRequest, header []byte) (string, error) {
+	if format := detectDiskFormat(header); format != "" {
+		return format, nil
+	}
+	if req.format == DiskFormatRaw || formatFromName(req.source) == DiskFormatRaw || req.verified {
+		return DiskFormatRaw, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// isZero determines whether a block of data is all zeros
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparse copies a raw disk to w, skipping chunks of zeros
+func writeSparse(w io.WriterAt, r io.Reader) error {
+	chunk := make([]byte, diskChunk)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 && !isZero(chunk[:n]) {
+			if _, err := w.WriteAt(chunk[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stageDisk writes a decompressed disk image to a file so it can be read at
+// random
+func stageDisk(filename string, r io.Reader) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		logx.LogReturnedErr(file.Close, log.Fields{
+			"filename": filename,
+		}, "failed to close staged disk")
+		return nil, err
+	}
+	return file, nil
+}
+
+// openZvol opens the device of a zvol, waiting for it to appear
+func openZvol(name string, flag int, cancel chan struct{}) (*os.File, error) {
+	device := filepath.Join("/dev/zvol", name)
+	deadline := time.Now().Add(zvolWait)
+	for {
+		file, err := os.OpenFile(device, flag, 0)
+		if err == nil || !os.IsNotExist(err) || time.Now().After(deadline) {
+			return file, err
+		}
+		select {
+		case <-cancel:
+			return nil, ErrCanceled
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// diskFilename is where a compressed raw or qcow2 image is decompressed to so
+// it can be read at random
+func diskFilename(tempdir, name string) string {
+	return filepath.Join(tempdir, name+".disk")
+}
+
+// importDisk creates a zvol the size of a raw or qcow2 disk image, writes the
+// disk to it and snapshots it. A compressed image is decompressed to a file of
+// its own first.
+func importDisk(req *fetchRequest, format string, file *os.File, compression string, decompressed io.Reader) (*zfs.Dataset, error) {
+	if compression != CompressionNone {
+		filename := diskFilename(req.tempdir, req.name)
+		disk, err := stageDisk(filename, &cancelReader{
+			reader: decompressed,
+			cancel: req.cancel,
+		})
+		defer func() {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				log.WithFields(log.Fields{
+					"error":    err,
+					"filename": filename,
+				}).Error("could not remove staged disk")
+			}
+		}()
+		if err != nil {
+			return nil, err
+		}
+		defer logx.LogReturnedErr(disk.Close, log.Fields{
+			"filename": filename,
+		}, "failed to close staged disk")
+		file = disk
+	}
+
+	var size int64
+	var write func(io.WriterAt) error
+	switch format {
+	case DiskFormatQcow2:
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		image, err := openQcow2(file, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		size = int64(image.size)
+		write = func(w io.WriterAt) error {
+			return image.writeTo(w, req.cancel)
+		}
+	case DiskFormatRaw:
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = fi.Size()
+		write = func(w io.WriterAt) error {
+			return writeSparse(w, &cancelReader{
+				reader: io.NewSectionReader(file, 0, size),
+				cancel: req.cancel,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported disk format %s", format)
+	}
+	if size <= 0 {
+		return nil, errors.New("empty disk image")
+	}
+
+	// zvols are sized in whole MB, like guest disks
+	volsize := uint64(size+1024*1024-1) / (1024 * 1024) * 1024 * 1024
+	volume, err := zfs.CreateVolume(req.dest, volsize, defaultZFSOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := false
+	defer func() {
+		if !imported {
+			destroyReceived(req)
+		}
+	}()
+
+	device, err := openZvol(volume.Name, os.O_WRONLY, req.cancel)
+	if err != nil {
+		return nil, err
+	}
+	if err := write(device); err != nil {
+		logx.LogReturnedErr(device.Close, log.Fields{
+			"device": device.Name(),
+		}, "failed to close zvol device")
+		return nil, err
+	}
+	if err := device.Sync(); err != nil {
+		logx.LogReturnedErr(device.Close, log.Fields{
+			"device": device.Name(),
+		}, "failed to close zvol device")
+		return nil, err
+	}
+	if err := device.Close(); err != nil {
+		return nil, err
+	}
+
+	if _, err := volume.Snapshot("import", false); err != nil {
+		return nil, err
+	}
+	imported = true
+	return volume, nil
+}
@@ -0,0 +1,276 @@
+package imagestore_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+)
+
+const qcow2ClusterBits = 16
+
+type DiskTestSuite struct {
+	APITestSuite
+	DiskService *httptest.Server
+	DiskData    []byte
+	Qcow2Data   []byte
+}
+
+func TestDiskTestSuite(t *testing.T) {
+	s := new(DiskTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *DiskTestSuite) configure(config *imagestore.Config) {
+	// A 2MB disk with data at the start and middle, and a hole in between
+	s.DiskData = make([]byte, 2*1024*1024)
+	for i := 0; i < 128*1024; i++ {
+		s.DiskData[i] = byte(i % 251)
+		s.DiskData[1024*1024+i] = byte(i % 241)
+	}
+	s.Qcow2Data = makeQcow2(s.DiskData)
+
+	s.DiskService = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data []byte
+		switch r.URL.Path {
+		case "/rawID":
+			data = s.DiskData
+		case "/qcow2ID":
+			data = s.Qcow2Data
+		case "/hugeL1ID":
+			// An l1 size far past the end of the file
+			data = append([]byte{}, s.Qcow2Data...)
+			binary.BigEndian.PutUint32(data[36:], 1<<28)
+		case "/shrunkID":
+			// An l1 table with an entry more than the image size needs,
+			// like one left by qemu-img resize --shrink
+			data = append([]byte{}, s.Qcow2Data...)
+			binary.BigEndian.PutUint32(data[36:], binary.BigEndian.Uint32(data[36:])+1)
+		case "/pageID":
+			data = []byte("<html><body>Not the image you're looking for</body></html>")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			log.WithField("error", err).Error("Failed to write mock disk data to response")
+		}
+	}))
+
+	config.Sources = map[string]string{
+		"disks": s.DiskService.URL + "/{id}",
+	}
+}
+
+func (s *DiskTestSuite) TearDownSuite() {
+	s.DiskService.Close()
+}
+
+// makeQcow2 creates a version 2 qcow2 image of a disk, with 64K clusters.
+// Clusters of zeros are left unallocated and every other allocated cluster is
+// compressed.
+func makeQcow2(disk []byte) []byte {
+	clusterSize := 1 << qcow2ClusterBits
+	buf := new(bytes.Buffer)
+
+	// Header in cluster 0, the L1 table in cluster 1 and the L2 table in
+	// cluster 2, with data clusters after
+	header := []interface{}{
+		[]byte("QFI\xfb"),
+		uint32(2),                // version
+		uint64(0),                // backing file offset
+		uint32(0),                // backing file size
+		uint32(qcow2ClusterBits), // cluster bits
+		uint64(len(disk)),        // size
+		uint32(0),                // crypt method
+		uint32(1),                // l1 size
+		uint64(clusterSize),      // l1 table offset
+		uint64(0),                // refcount table offset
+		uint32(0),                // refcount table clusters
+		uint32(0),                // snapshots
+		uint64(0),                // snapshots offset
+	}
+	for _, field := range header {
+		_ = binary.Write(buf, binary.BigEndian, field)
+	}
+	buf.Write(make([]byte, clusterSize-buf.Len()))
+
+	l1 := make([]byte, clusterSize)
+	binary.BigEndian.PutUint64(l1, uint64(2*clusterSize))
+	buf.Write(l1)
+
+	l2 := make([]byte, clusterSize)
+	l2Offset := buf.Len()
+	buf.Write(l2)
+
+	compress := false
+	for i := 0; i*clusterSize < len(disk); i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, disk[i*clusterSize:])
+		if bytes.Count(cluster, []byte{0}) == len(cluster) {
+			continue
+		}
+
+		offset := uint64(buf.Len())
+		entry := offset
+		if compress {
+			compressed := new(bytes.Buffer)
+			writer, _ := flate.NewWriter(compressed, flate.BestCompression)
+			_, _ = writer.Write(cluster)
+			_ = writer.Close()
+			buf.Write(compressed.Bytes())
+			// Pad to whole sectors
+			sectors := (compressed.Len() + 511) / 512
+			buf.Write(make([]byte, sectors*512-compressed.Len()))
+
+			offsetBits := uint(62 - (qcow2ClusterBits - 8))
+			entry = 1<<62 | uint64(sectors-1)<<offsetBits | offset
+		} else {
+			buf.Write(cluster)
+		}
+		binary.BigEndian.PutUint64(buf.Bytes()[l2Offset+i*8:], entry)
+		compress = !compress
+	}
+	return buf.Bytes()
+}
+
+func (s *DiskTestSuite) TestRequestImageDisk() {
+	tests := []struct {
+		id     string
+		hint   string
+		format string
+	}{
+		{"rawID", imagestore.DiskFormatRaw, imagestore.DiskFormatRaw},
+		{"qcow2ID", "", imagestore.DiskFormatQcow2},
+		{"shrunkID", "", imagestore.DiskFormatQcow2},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.id)
+		request := &imagestore.ImageRequest{
+			ImageRequest: rpc.ImageRequest{ID: test.id},
+			Source:       "disks",
+			Format:       test.hint,
+		}
+		response := &imagestore.ImageResponse{}
+		s.NoError(s.Client.Do("ImageStore.RequestImage", request, response), msg("should not error"))
+		s.Len(response.Images, 1, msg("should return the image"))
+		s.Equal(imagestore.ImageStatusComplete, response.Images[0].Status, msg("should be complete"))
+		s.Equal(test.format, response.Images[0].Format, msg("should record the format"))
+		s.Equal(uint64(2), response.Images[0].Size, msg("should be the size of the disk"))
+
+		device := filepath.Join("/dev/zvol", response.Images[0].Volume)
+		file, err := os.Open(device)
+		if !s.NoError(err, msg("should open the zvol")) {
+			continue
+		}
+		contents := make([]byte, len(s.DiskData))
+		_, err = io.ReadFull(file, contents)
+		s.NoError(err, msg("should read the zvol"))
+		s.True(bytes.Equal(s.DiskData, contents), msg("should have the disk contents"))
+		logx.LogReturnedErr(file.Close, nil, "failed to close zvol")
+
+		cloneResponse := &rpc.VolumeResponse{}
+		cloneRequest := &rpc.ImageRequest{ID: test.id, Dest: filepath.Join(s.ID, "clone-"+test.id)}
+		s.NoError(s.Client.Do("ImageStore.CloneImage", cloneRequest, cloneResponse), msg("should clone"))
+	}
+}
+
+func (s *DiskTestSuite) TestRequestImageUnknownFormat() {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: "pageID"},
+		Source:       "disks",
+	}
+	s.Error(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}), "should not import an unrecognized image without a raw hint")
+
+	request.Format = imagestore.DiskFormatQcow2
+	s.Error(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}), "should only take a raw format hint")
+}
+
+func (s *DiskTestSuite) TestRequestImageBadQcow2() {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: "hugeL1ID"},
+		Source:       "disks",
+	}
+	s.Error(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}), "should reject an l1 table past the end of the file")
+}
+
+func (s *DiskTestSuite) TestExportDisk() {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: "rawID"},
+		Source:       "disks",
+		Format:       imagestore.DiskFormatRaw,
+	}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}))
+
+	// special client for the non-rpc call
+	client, _ := rpc.NewClient(uint(s.Port), "/disks/export")
+
+	tests := []struct {
+		description        string
+		request            *imagestore.ExportRequest
+		expectedStatusCode int
+	}{
+		{"missing request",
+			nil, http.StatusBadRequest},
+		{"missing id",
+			&imagestore.ExportRequest{}, http.StatusBadRequest},
+		{"non-existant id",
+			&imagestore.ExportRequest{ID: "asdf"}, http.StatusNotFound},
+		{"non-existant image",
+			&imagestore.ExportRequest{Image: "asdf"}, http.StatusNotFound},
+		{"id outside the zpool",
+			&imagestore.ExportRequest{ID: "../" + s.ID + "/images/rawID"}, http.StatusBadRequest},
+		{"invalid format",
+			&imagestore.ExportRequest{Image: "rawID", Format: "vmdk"}, http.StatusBadRequest},
+		{"invalid compression",
+			&imagestore.ExportRequest{Image: "rawID", Compression: "rar"}, http.StatusBadRequest},
+		{"raw",
+			&imagestore.ExportRequest{Image: "rawID"}, http.StatusOK},
+		{"raw gzip",
+			&imagestore.ExportRequest{Image: "rawID", Compression: imagestore.CompressionGzip}, http.StatusOK},
+		{"qcow2",
+			&imagestore.ExportRequest{Image: "rawID", Format: imagestore.DiskFormatQcow2}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := httptest.NewRecorder()
+		client.DoRaw(test.request, response)
+		s.Equal(test.expectedStatusCode, response.Code, msg("should return expected http status code"))
+		if response.Code != http.StatusOK {
+			continue
+		}
+
+		data := response.Body.Bytes()
+		switch {
+		case test.request.Compression == imagestore.CompressionGzip:
+			reader, err := gzip.NewReader(response.Body)
+			if !s.NoError(err, msg("should be gzipped")) {
+				continue
+			}
+			data, err = ioutil.ReadAll(reader)
+			s.NoError(err, msg("should decompress"))
+			s.True(bytes.Equal(s.DiskData, data), msg("should have the disk contents"))
+		case test.request.Format == imagestore.DiskFormatQcow2:
+			s.True(bytes.HasPrefix(data, []byte("QFI\xfb")), msg("should be a qcow2 image"))
+			s.True(len(data) < len(s.DiskData), msg("should leave out clusters of zeros"))
+		default:
+			s.True(bytes.Equal(s.DiskData, data), msg("should have the disk contents"))
+		}
+	}
+}
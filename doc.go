@@ -8,7 +8,19 @@ HTTP API Endpoints
 		* GET - Run a specified method
 
 	/snapshots/download
-		* GET - Streaming download a zfs snapshot. Query with SnapshotRequest.
+		* GET - Streaming download a zfs snapshot, optionally incremental. Query with SnapshotDownloadRequest.
+
+	/snapshots/upload
+		* POST - Streaming upload of a full or incremental zfs snapshot into a dataset under guests. Query string params id, force, resumable, compression and prune.
+
+	/images/{id}/download
+		* GET - Streaming download of an image as a zfs snapshot, for peer agents. The X-Image-Checksum header has its checksum. Not found until the checksum has been computed, which the first request starts.
+
+	/images/{id}/checksum
+		* GET - Checksum of an image download, for peer agents.
+
+	/disks/export
+		* GET - Streaming download a volume, snapshot or image as a raw or qcow2 disk. Query with ExportRequest. Raw disks are sent in full, zeros and all; qcow2 disks leave out clusters of zeros.
 
 Request Structure
 
@@ -41,8 +53,24 @@ RPC Methods
 	ListImages
 	GetImage
 	RequestImage
+	CancelImageRequest
 	DeleteImage
 	CloneImage
+	GetImageDependents
+	PinImage
+	UnpinImage
+	SetImageLabels
+	RemoveImageLabels
+	SetImageAlias
+	RemoveImageAlias
+	ReconcileImages
+	RebuildImages
+
+	SetBandwidthLimit
+	GetFetchStats
+	GetFetchQueue
+	GetGCHistory
+	CollectImages
 
 	ListSnapshot
 	GetSnapshot
@@ -50,9 +78,14 @@ RPC Methods
 	DeleteSnapshot
 	RollbackSnapshot
 
+	GetReceiveState
+	AbortReceive
+
 	VerifyDisks
 	CreateGuestDisks
 	DeleteGuestDisks
+	MigrateGuestDisks
+	GetGuestMigration
 
 See the godocs and function signatures for each method's purpose and expected
 request/response structs.
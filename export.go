@@ -0,0 +1,231 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+// exportSnapshotPrefix starts the names of the temporary snapshots and clones
+// of disk exports
+const exportSnapshotPrefix = "export-"
+
+type (
+	// ExportRequest is the request for ExportDisk
+	ExportRequest struct {
+		ID          string `json:"id"`          // volume or snapshot, relative to the zpool
+		Image       string `json:"image"`       // image ID, instead of id
+		Format      string `json:"format"`      // DiskFormatRaw, the default, or DiskFormatQcow2
+		Compression string `json:"compression"` // CompressionNone, the default, CompressionGzip, CompressionZstd or CompressionXz
+	}
+
+	// exportTracker tracks the temporary clones of exports in progress, so
+	// reconciling only removes ones left behind
+	exportTracker struct {
+		lock   sync.Mutex
+		clones map[string]bool
+	}
+)
+
+func newExportTracker() *exportTracker {
+	return &exportTracker{
+		clones: make(map[string]bool),
+	}
+}
+
+// add tracks a clone before it's created
+func (t *exportTracker) add(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.clones[name] = true
+}
+
+// remove stops tracking a clone once it's destroyed
+func (t *exportTracker) remove(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.clones, name)
+}
+
+// active checks whether a clone belongs to an export in progress
+func (t *exportTracker) active(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.clones[name]
+}
+
+/*
+ExportDisk downloads a volume, snapshot or image as a raw or qcow2 disk file.
+Volumes are snapshotted first so the export is consistent. Clusters of zeros
+are left out of qcow2 files, so they are much smaller than raw files of sparse
+disks. Raw exports are not sparse: a stream has no way to skip the zeros, so
+every byte of the disk is sent. Compress them, or write them out with a tool
+that makes holes of zeros such as cp --sparse=always, to keep them small.
+
+	Request params:
+	id          string : Req : Name of the volume or snapshot
+	image       string : Req : ID of the image, instead of id
+	format      string :     : raw or qcow2
+	compression string :     : none, gzip, zstd or xz
+*/
+func (store *ImageStore) ExportDisk(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var request ExportRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.ID == "" && request.Image == "" {
+		http.Error(w, "need an id or image", http.StatusBadRequest)
+		return
+	}
+	if request.Format == "" {
+		request.Format = DiskFormatRaw
+	}
+	if request.Format != DiskFormatRaw && request.Format != DiskFormatQcow2 {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	if request.Compression == "" {
+		request.Compression = CompressionNone
+	}
+	switch request.Compression {
+	case CompressionNone, CompressionGzip, CompressionZstd, CompressionXz:
+	default:
+		http.Error(w, "invalid compression", http.StatusBadRequest)
+		return
+	}
+
+	snapshot, cleanup, err := store.exportSnapshot(&request)
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case ErrNotVolume, ErrNotValid, ErrNotReady:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer cleanup()
+
+	// Snapshots have no device of their own, so read a temporary clone. The
+	// clones are kept out of the image store, as they inherit the user
+	// properties of images.
+	cloneName := filepath.Join(store.exportDataset, fmt.Sprintf("%s%d", exportSnapshotPrefix, time.Now().UnixNano()))
+	store.exports.add(cloneName)
+	defer store.exports.remove(cloneName)
+	clone, err := snapshot.Clone(cloneName, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logx.LogReturnedErr(func() error { return clone.Destroy(false) },
+		log.Fields{"dataset": clone.Name}, "failed to destroy export clone")
+
+	device, err := openZvol(clone.Name, os.O_RDONLY, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logx.LogReturnedErr(device.Close, log.Fields{
+		"device": device.Name(),
+	}, "failed to close zvol device")
+
+	var layout *qcow2Layout
+	length := int64(clone.Volsize)
+	if request.Format == DiskFormatQcow2 {
+		layout, err = newQcow2Layout(device, clone.Volsize, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		length = layout.length()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if request.Compression == CompressionNone {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+
+	compressed, err := compressor(w, request.Compression)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if layout != nil {
+		err = layout.writeTo(compressed, nil)
+	} else {
+		_, err = io.Copy(compressed, io.NewSectionReader(device, 0, length))
+	}
+	if err == nil {
+		err = compressed.Close()
+	}
+	if err != nil {
+		// The headers are already sent, so all that can be done is to stop
+		log.WithFields(log.Fields{
+			"error":   err,
+			"request": request,
+		}).Error("disk export failed")
+	}
+}
+
+// exportSnapshot finds the snapshot to export, snapshotting a volume if
+// needed. The returned function cleans up any snapshot that was taken.
+func (store *ImageStore) exportSnapshot(request *ExportRequest) (*zfs.Dataset, func(), error) {
+	noop := func() {}
+
+	if request.Image != "" {
+		image, err := store.getReadyImage(request.Image)
+		if err != nil {
+			return nil, noop, err
+		}
+		snapshot, err := zfs.GetDataset(image.Snapshot)
+		if err != nil {
+			return nil, noop, err
+		}
+		return snapshot, noop, nil
+	}
+
+	if !validDatasetName(request.ID) {
+		return nil, noop, ErrNotValid
+	}
+	ds, err := zfs.GetDataset(filepath.Join(store.config.Zpool, request.ID))
+	if err != nil {
+		if isZfsNotFound(err) {
+			return nil, noop, ErrNotFound
+		}
+		if isZfsInvalid(err) {
+			return nil, noop, ErrNotValid
+		}
+		return nil, noop, err
+	}
+
+	switch ds.Type {
+	case "snapshot":
+		return ds, noop, nil
+	case "volume":
+		snapshot, err := ds.Snapshot(fmt.Sprintf("%s%d", exportSnapshotPrefix, time.Now().UnixNano()), false)
+		if err != nil {
+			return nil, noop, err
+		}
+		return snapshot, func() {
+			logx.LogReturnedErr(func() error { return snapshot.Destroy(false) },
+				log.Fields{"snapshot": snapshot.Name}, "failed to destroy export snapshot")
+		}, nil
+	}
+	return nil, noop, ErrNotVolume
+}
@@ -2,37 +2,85 @@ package imagestore
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/go-zfs"
-	"github.com/mistifyio/mistify-agent/rpc"
 	logx "github.com/mistifyio/mistify-logrus-ext"
 )
 
 type (
 	// fetchRequest contains information needed to fetch and store an image
 	fetchRequest struct {
-		name     string
-		source   string
-		dest     string
-		tempdir  string
-		response chan *fetchResponse
+		name string
+		// where the image can be fetched from, in the order to try them
+		locations []fetchLocation
+		// the location currently being fetched from
+		peer            bool
+		mirror          string
+		source          string
+		checksumSource  string
+		signatureSource string
+		dest            string
+		tempdir         string
+		response        chan *fetchResponse
+		// closed when the fetch is canceled
+		cancel chan struct{}
+		// receive the image as it is downloaded instead of staging it in
+		// tempdir first
+		stream bool
+		// compression format the source claims the image has, if any
+		compression string
+		// disk format the request says the image has, if any
+		format string
+		// the image matched the checksum it was expected to have
+		verified bool
+		// room was reserved in the queue for a new fetch
+		reserved bool
+		// the caller went away before the fetch finished
+		abandoned bool
+		// dest didn't exist before the fetch, so it is the fetch's to
+		// destroy if the fetch fails
+		ownsDest bool
 	}
 
 	// fetchResponse contains the results of fetching an image
 	fetchResponse struct {
-		err      error
-		dataset  *zfs.Dataset
-		snapshot *zfs.Dataset
+		err         error
+		dataset     *zfs.Dataset
+		snapshot    *zfs.Dataset
+		compression string
+		format      string
+	}
+
+	// progressWriter records the progress of a download on the image
+	progressWriter struct {
+		store   *ImageStore
+		name    string
+		written uint64
+		saved   time.Time
+	}
+
+	// cancelReader stops reading once a fetch is canceled
+	cancelReader struct {
+		reader io.Reader
+		cancel chan struct{}
+	}
+
+	// cancelWriter stops writing once its cancel channel is closed
+	cancelWriter struct {
+		writer io.Writer
+		cancel chan struct{}
 	}
 
 	// fetcher fetches images. It shares a response with fetch requests for the
@@ -45,6 +93,17 @@ type (
 
 		lock            sync.Mutex
 		currentRequests map[string][]*fetchRequest
+		cancelChans     map[string]chan struct{}
+		// image sources by url scheme
+		sources map[string]imageSource
+		retry   RetryConfig
+		// bandwidth of all downloads, and of each download in progress by
+		// image ID
+		bandwidth  *throttle
+		fetchLimit int64
+		throttles  map[string]*throttle
+		// admission control of new fetches
+		queue fetchQueue
 	}
 
 	// ErrorHTTPCode should be used for errors resulting from an http response
@@ -61,8 +120,72 @@ func (e ErrorHTTPCode) Error() string {
 	return fmt.Sprintf("unexpected http response code: expected %d, received %d, url: %s", e.Expected, e.Code, e.Source)
 }
 
+// progressInterval is how often download progress is saved to the image
+const progressInterval = time.Second
+
+// Write counts the bytes written and periodically saves the count
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += uint64(len(b))
+	if time.Since(p.saved) >= progressInterval {
+		p.save()
+	}
+	return len(b), nil
+}
+
+// newProgressWriter records the size of a download on the image and returns a
+// writer to record its progress with
+func (f *fetcher) newProgressWriter(req *fetchRequest, offset, size int64) *progressWriter {
+	f.store.updateImageLogged(req.name, func(image *Image) {
+		image.BytesDownloaded = uint64(offset)
+		image.TotalSize = 0
+		if size > 0 {
+			image.TotalSize = uint64(size)
+		}
+	})
+	return &progressWriter{
+		store:   f.store,
+		name:    req.name,
+		written: uint64(offset),
+		saved:   time.Now(),
+	}
+}
+
+// save records the number of bytes written on the image
+func (p *progressWriter) save() {
+	p.saved = time.Now()
+	p.store.updateImageLogged(p.name, func(image *Image) {
+		image.BytesDownloaded = p.written
+	})
+}
+
+// Read reads from the underlying reader unless the fetch has been canceled
+func (c *cancelReader) Read(b []byte) (int, error) {
+	if isCanceled(c.cancel) {
+		return 0, ErrCanceled
+	}
+	return c.reader.Read(b)
+}
+
+// Write writes to the underlying writer unless it has been canceled
+func (c *cancelWriter) Write(b []byte) (int, error) {
+	if isCanceled(c.cancel) {
+		return 0, ErrCanceled
+	}
+	return c.writer.Write(b)
+}
+
+// isCanceled determines whether a cancel channel has been closed
+func isCanceled(cancel chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
 // newFetcher creates a new fetcher
-func newFetcher(store *ImageStore, maxPending, concurrency uint) *fetcher {
+func newFetcher(store *ImageStore, sources map[string]imageSource, retry RetryConfig, maxPending, concurrency uint, queueWait time.Duration) *fetcher {
 	if concurrency <= 0 {
 		concurrency = 5
 	}
@@ -73,6 +196,17 @@ func newFetcher(store *ImageStore, maxPending, concurrency uint) *fetcher {
 		quitChan:        make(chan struct{}),
 		pendingRequests: make(chan *fetchRequest, maxPending),
 		currentRequests: make(map[string][]*fetchRequest),
+		cancelChans:     make(map[string]chan struct{}),
+		sources:         sources,
+		retry:           retry.withDefaults(),
+		bandwidth:       newThrottle(0),
+		throttles:       make(map[string]*throttle),
+		queue: fetchQueue{
+			maxPending: maxPending,
+			wait:       queueWait,
+			queued:     make(map[string]bool),
+			changed:    make(chan struct{}),
+		},
 	}
 
 	// Fill concurrencyChan
@@ -83,55 +217,315 @@ func newFetcher(store *ImageStore, maxPending, concurrency uint) *fetcher {
 	return f
 }
 
-// download fetches an external image to the local machine
-func (f *fetcher) download(req *fetchRequest, dest string) error {
-	temp, err := ioutil.TempFile(req.tempdir, req.name)
+// partialFilename is where an in-progress download of an image is kept so it
+// can be resumed
+func partialFilename(tempdir, name string) string {
+	return filepath.Join(tempdir, name+".partial")
+}
+
+// validatorFilename is where the validator of an in-progress download is
+// kept, to make sure a resumed download is of the same image
+func validatorFilename(tempdir, name string) string {
+	return filepath.Join(tempdir, name+".partial.validator")
+}
+
+// useLocation sets the location an image is fetched from
+func (req *fetchRequest) useLocation(location fetchLocation) {
+	req.peer = location.peer
+	req.mirror = location.mirror
+	req.source = location.source
+	req.checksumSource = location.checksum
+	req.signatureSource = location.signature
+}
+
+// originLocation returns the first location that isn't a peer agent
+func (req *fetchRequest) originLocation() fetchLocation {
+	for _, location := range req.locations {
+		if !location.peer {
+			return location
+		}
+	}
+	return req.locations[0]
+}
+
+// download fetches an external image with from, trying each location in turn
+// while the failures are the fault of the image server. It returns the
+// checksum of the download.
+func (f *fetcher) download(req *fetchRequest, from func() (string, error)) (string, error) {
+	var err error
+	for i, location := range req.locations {
+		req.useLocation(location)
+
+		var checksum string
+		checksum, err = from()
+		if err == nil {
+			if location.pool != nil {
+				location.pool.markHealthy(location.mirror)
+			}
+			return checksum, nil
+		}
+
+		// Peers may not have the image, or a good copy of it, so anything
+		// that goes wrong with one moves on to the next location
+		failover := isFailoverError(err)
+		if isCanceled(req.cancel) || (!failover && !location.peer) {
+			return "", err
+		}
+		if failover && location.pool != nil {
+			location.pool.markFailed(location.mirror)
+		}
+		if i < len(req.locations)-1 {
+			log.WithFields(log.Fields{
+				"req":   req,
+				"error": err,
+			}).Warning("image download failed, trying next location")
+		}
+	}
+	return "", err
+}
+
+// downloadWithRetry downloads an image, retrying transient failures with
+// backoff. Each attempt and the last error are recorded on the image.
+func (f *fetcher) downloadWithRetry(req *fetchRequest, from func() (string, error)) (string, error) {
+	for attempt := 1; ; attempt++ {
+		f.store.updateImageLogged(req.name, func(image *Image) {
+			image.Attempts = attempt
+		})
+
+		checksum, err := f.download(req, from)
+		if err == nil {
+			return checksum, nil
+		}
+
+		f.store.updateImageLogged(req.name, func(image *Image) {
+			image.LastError = err.Error()
+		})
+		if isCanceled(req.cancel) || !f.retry.isRetryable(err) || attempt >= f.retry.MaxAttempts {
+			return "", err
+		}
+
+		backoff := f.retry.backoff(attempt)
+		log.WithFields(log.Fields{
+			"req":     req,
+			"attempt": attempt,
+			"error":   err,
+			"backoff": backoff,
+		}).Warning("image download failed, retrying")
+
+		select {
+		case q := <-f.quitChan:
+			f.quitChan <- q
+			return "", err
+		case <-req.cancel:
+			return "", ErrCanceled
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// downloadFrom fetches an external image from the current location, verifying
+// it against the expected checksum. It returns the checksum of the download.
+// Interrupted downloads are kept and resumed the next time, as long as the
+// source identified the image with a validator.
+func (f *fetcher) downloadFrom(req *fetchRequest, dest string) (string, error) {
+	partialName := partialFilename(req.tempdir, req.name)
+	validatorName := validatorFilename(req.tempdir, req.name)
+
+	source, err := f.sourceFor(req.source)
 	if err != nil {
-		return err
+		return "", err
 	}
-	// In case of a failure, remove the temp file
+
+	partial, err := os.OpenFile(partialName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	// In case of an unresumable failure, remove the partial file
+	keepPartial := false
 	successfulDownload := false
 	defer func() {
-		if !successfulDownload {
-			if err := os.Remove(temp.Name()); err != nil {
-				log.WithFields(log.Fields{
-					"error":    err,
-					"filename": temp.Name(),
-				}).Error("could not remove temp file")
+		if !successfulDownload && !keepPartial {
+			for _, filename := range []string{partialName, validatorName} {
+				if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+					log.WithFields(log.Fields{
+						"error":    err,
+						"filename": filename,
+					}).Error("could not remove partial download file")
+				}
 			}
 		}
 	}()
-	defer logx.LogReturnedErr(temp.Close, log.Fields{
-		"filename": temp.Name(),
-	}, "failed to close temp file")
+	defer logx.LogReturnedErr(partial.Close, log.Fields{
+		"filename": partialName,
+	}, "failed to close partial download file")
+
+	// Hash whatever was already downloaded, which leaves the offset at the end
+	// of the file for appending
+	hash := sha256.New()
+	offset, err := io.Copy(hash, partial)
+	if err != nil {
+		return "", err
+	}
 
-	resp, err := http.Get(req.source)
+	validator, err := ioutil.ReadFile(validatorName)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if offset > 0 && len(validator) > 0 {
+		log.WithFields(log.Fields{
+			"req":    req,
+			"offset": offset,
+		}).Info("resuming download")
+	}
+
+	file, err := source.open(req.source, offset, string(validator), req.cancel)
 	if err != nil {
-		return err
+		keepPartial = offset > 0 && len(validator) > 0
+		return "", err
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"source": req.source,
+	}, "failed to close source file")
+
+	if file.offset != offset {
+		// Either a fresh download, or the source couldn't or wouldn't resume
+		// it, so start over
+		if offset > 0 {
+			log.WithField("req", req).Info("source did not resume download, restarting")
+		}
+		offset = 0
+		if err := partial.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := partial.Seek(0, 0); err != nil {
+			return "", err
+		}
+		hash.Reset()
 	}
-	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
 
-	if resp.StatusCode != http.StatusOK {
-		return ErrorHTTPCode{
-			Expected: http.StatusOK,
-			Code:     resp.StatusCode,
-			Source:   req.source,
+	// Keep the validator for resuming this download if it is interrupted
+	validator = []byte(file.validator)
+	if len(validator) > 0 {
+		if err := ioutil.WriteFile(validatorName, validator, 0644); err != nil {
+			return "", err
 		}
+	} else if err := os.Remove(validatorName); err != nil && !os.IsNotExist(err) {
+		return "", err
 	}
 
-	if _, err = io.Copy(temp, resp.Body); err != nil {
-		return err
+	expected, err := f.expectedChecksum(req, file.checksum)
+	if err != nil {
+		keepPartial = len(validator) > 0
+		return "", err
+	}
+	req.compression = sourceCompression(req.source, file)
+
+	progress := f.newProgressWriter(req, offset, file.size)
+	defer progress.save()
+
+	// Hash the image as it is written so it doesn't need to be read again
+	reader, done := f.throttleDownload(req, &cancelReader{
+		reader: file,
+		cancel: req.cancel,
+	})
+	defer done()
+	if _, err = io.Copy(io.MultiWriter(partial, hash, progress), reader); err != nil {
+		keepPartial = len(validator) > 0
+		return "", err
 	}
 
-	if err := temp.Close(); err != nil {
-		return err
+	checksum := checksumPrefix + hex.EncodeToString(hash.Sum(nil))
+	if err := verifyChecksum(req, expected, checksum); err != nil {
+		return "", err
 	}
 
-	if err := os.Rename(temp.Name(), dest); err != nil {
-		return err
+	if err := partial.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(partialName, dest); err != nil {
+		return "", err
 	}
 	successfulDownload = true
-	return nil
+
+	if err := os.Remove(validatorName); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"error":    err,
+			"filename": validatorName,
+		}).Error("could not remove validator file")
+	}
+	return checksum, nil
+}
+
+// verifyCached checks a previously downloaded image against the expected
+// checksum, removing it if it doesn't match. It returns the checksum of the
+// cached file.
+func (f *fetcher) verifyCached(req *fetchRequest, filename string) (string, error) {
+	expected, err := f.expectedChecksum(req, "")
+	if err != nil {
+		return "", err
+	}
+
+	checksum, err := fileChecksum(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if err := verifyChecksum(req, expected, checksum); err != nil {
+		if err := os.Remove(filename); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("could not remove cache file")
+		}
+		return "", err
+	}
+	return checksum, nil
+}
+
+// verifySignature checks a downloaded image against the trust store and
+// returns the ID of the key that signed it. Images without a valid signature
+// are removed and rejected.
+func (f *fetcher) verifySignature(req *fetchRequest, filename, checksum string) (string, error) {
+	signature, err := f.fetchSignature(req.signatureSource)
+	if err != nil && err != ErrNoSignature {
+		return "", err
+	}
+
+	var keyID string
+	if err == nil {
+		keyID, err = f.store.trustStore.verify(filename, checksum, signature)
+	}
+	if err != nil {
+		if err := os.Remove(filename); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("could not remove cache file")
+		}
+		return "", ErrorRejected{
+			ID:     req.name,
+			Reason: err,
+		}
+	}
+	return keyID, nil
+}
+
+// reject records an image that failed verification so the reason can be
+// looked up later
+func (f *fetcher) reject(req *fetchRequest, checksum string, reason error) {
+	log.WithFields(log.Fields{
+		"req":   req,
+		"error": reason,
+	}).Error("image rejected")
+
+	f.store.updateImageLogged(req.name, func(image *Image) {
+		image.Status = ImageStatusRejected
+		image.Checksum = checksum
+		image.Verified = false
+		image.SigningKey = ""
+		image.Error = reason.Error()
+	})
 }
 
 // importImage takes an image snapshot and imports it to zfs
@@ -150,29 +544,37 @@ func (f *fetcher) importImage(req *fetchRequest) *fetchResponse {
 		"filename": filename,
 	}, "failed to close cachefile")
 
-	// Use a response buffer so the first few bytes can be peeked at for file
-	// type detection. Uncompress the image if it is gzipped
-	fileBuffer := bufio.NewReader(cachedFile)
-	var cacheFileReader io.Reader = fileBuffer
+	cacheFileReader, compression, err := decompress(cachedFile, req.compression)
+	if err != nil {
+		fetchResp.err = err
+		return fetchResp
+	}
+	fetchResp.compression = compression
+	defer logx.LogReturnedErr(cacheFileReader.Close, nil, "failed to close decompressor")
 
-	filetypeBytes, err := fileBuffer.Peek(512)
+	// Peek at the decompressed image to tell what kind of disk it is
+	decompressed := bufio.NewReader(cacheFileReader)
+	header, err := decompressed.Peek(512)
 	if err != nil && err != io.EOF {
 		fetchResp.err = err
 		return fetchResp
 	}
-
-	if http.DetectContentType(filetypeBytes) == "application/x-gzip" {
-		gzipReader, err := gzip.NewReader(fileBuffer)
-		if err != nil {
-			fetchResp.err = err
-			return fetchResp
-		}
-		defer logx.LogReturnedErr(gzipReader.Close, nil, "failed to close gzipreader")
-		cacheFileReader = gzipReader
+	fetchResp.format, err = diskFormat(req, header)
+	if err != nil {
+		fetchResp.err = err
+		return fetchResp
 	}
 
 	// Import the image
-	dataset, err := zfs.ReceiveSnapshot(cacheFileReader, req.dest)
+	var dataset *zfs.Dataset
+	if fetchResp.format == DiskFormatZfs {
+		dataset, err = zfs.ReceiveSnapshot(&cancelReader{
+			reader: decompressed,
+			cancel: req.cancel,
+		}, req.dest)
+	} else {
+		dataset, err = importDisk(req, fetchResp.format, cachedFile, compression, decompressed)
+	}
 	if err != nil {
 		fetchResp.err = err
 		return fetchResp
@@ -205,55 +607,233 @@ func (f *fetcher) fetchImage(req *fetchRequest) {
 	select {
 	case q := <-f.quitChan:
 		f.quitChan <- q
+		f.dropQueued(req)
+		f.finish(req, &fetchResponse{err: errors.New("fetcher quit")})
+		return
+	case <-req.cancel:
+		f.dropQueued(req)
+		f.finish(req, &fetchResponse{err: ErrCanceled})
 		return
 	case <-f.concurrentChan:
 	}
-	defer func() { f.concurrentChan <- struct{}{} }()
+	f.startQueued(req)
+	defer func() {
+		f.endInFlight(req)
+		f.concurrentChan <- struct{}{}
+	}()
 	log.WithField("req", req).Debug("beginning fetch")
 
-	// Check for a cached image
+	if err := claimDest(req); err != nil {
+		f.finish(req, &fetchResponse{err: err})
+		return
+	}
+
+	f.store.updateImageLogged(req.name, func(image *Image) {
+		image.Status = ImageStatusDownloading
+	})
+
+	if req.stream {
+		log.WithField("req", req).Debug("stream image")
+		f.finish(req, f.streamImage(req))
+		return
+	}
+
+	// Check for a cached image, which is verified against the first location
+	// that isn't a peer
+	req.useLocation(req.originLocation())
 	cachedFilename := filepath.Join(req.tempdir, req.name)
 	_, err := os.Stat(cachedFilename)
 
-	// Download the image if a cached file wasn't found
+	var checksum string
 	if err != nil {
-		fetchResp := &fetchResponse{}
-
 		if !os.IsNotExist(err) {
-			fetchResp.err = err
-			f.shareResponse(req.name, fetchResp)
+			f.finish(req, &fetchResponse{err: err})
 			return
 		}
 
+		// Download the image if a cached file wasn't found
 		log.WithField("req", req).Debug("download image")
-		if err := f.download(req, cachedFilename); err != nil {
-			fetchResp.err = err
-			f.shareResponse(req.name, fetchResp)
+		checksum, err = f.downloadWithRetry(req, func() (string, error) {
+			return f.downloadFrom(req, cachedFilename)
+		})
+	} else {
+		// The cached file may predate the current checksum, so verify it
+		log.WithField("req", req).Debug("verify cached image")
+		checksum, err = f.verifyCached(req, cachedFilename)
+	}
+	if err != nil {
+		f.finish(req, &fetchResponse{err: err})
+		return
+	}
+
+	// Only import images signed by a trusted key
+	var keyID string
+	if f.store.trustStore != nil {
+		log.WithField("req", req).Debug("verify image signature")
+		keyID, err = f.verifySignature(req, cachedFilename, checksum)
+		if err != nil {
+			if _, ok := err.(ErrorRejected); ok {
+				f.reject(req, checksum, err)
+			}
+			f.finish(req, &fetchResponse{err: err})
 			return
 		}
 	}
 
 	// Import the file into zfs
 	log.WithField("req", req).Debug("import image")
+	f.store.updateImageLogged(req.name, func(image *Image) {
+		image.Status = ImageStatusImporting
+	})
 	fetchResp := f.importImage(req)
-
-	// Save the image information
 	if fetchResp.err == nil {
-		image := &rpc.Image{
-			ID:       req.name,
-			Volume:   fetchResp.dataset.Name,
-			Snapshot: fetchResp.snapshot.Name,
-			Size:     fetchResp.snapshot.Volsize / 1024 / 1024,
-			Status:   "complete",
+		f.complete(req, fetchResp, checksum, keyID)
+	}
+
+	log.WithField("req", req).Debug("return response")
+	f.finish(req, fetchResp)
+}
+
+// complete saves the information of a successfully imported image
+func (f *fetcher) complete(req *fetchRequest, fetchResp *fetchResponse, checksum, keyID string) {
+	// A peer serves the send stream of its copy, so what was fetched is
+	// the send stream and the checksum of the image is the origin's. The
+	// send stream of an image fetched from an image server is only hashed
+	// once a peer asks for it.
+	sent := ""
+	if req.peer {
+		sent = checksum
+		checksum = f.originChecksum(req)
+	}
+
+	err := f.store.updateImage(req.name, func(image *Image) {
+		image.Volume = fetchResp.dataset.Name
+		image.Snapshot = fetchResp.snapshot.Name
+		image.Size = fetchResp.snapshot.Volsize / 1024 / 1024
+		image.Status = ImageStatusComplete
+		image.Checksum = checksum
+		image.Source = req.source
+		image.Mirror = req.mirror
+		image.Verified = keyID != ""
+		image.SigningKey = keyID
+		image.Compression = fetchResp.compression
+		image.Format = fetchResp.format
+		image.SendChecksum = sent
+		image.Error = ""
+		image.Fetched = time.Now()
+		image.LastUsed = image.Fetched
+	})
+	if err != nil {
+		fetchResp.err = err
+	}
+}
+
+// originChecksum gets the checksum of an image from the first location that
+// isn't a peer, for an image fetched from a peer. It is empty if there's no
+// such location or it has no checksum.
+func (f *fetcher) originChecksum(req *fetchRequest) string {
+	origin := req.originLocation()
+	if origin.peer {
+		return ""
+	}
+	checksum, err := f.fetchChecksum(origin.checksum)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"req":   req,
+			"error": err,
+		}).Warning("could not get the checksum of the image from its origin")
+	}
+	return checksum
+}
+
+// finish records the outcome of a failed fetch on the image and shares the
+// response with all waiting requests. Rejected images already have their
+// outcome recorded.
+func (f *fetcher) finish(req *fetchRequest, resp *fetchResponse) {
+	// A fetch that was canceled fails with whatever error interrupting it
+	// caused, so replace that with the reason it was interrupted
+	if resp.err != nil && isCanceled(req.cancel) {
+		f.cleanupCanceled(req)
+		resp = &fetchResponse{err: ErrCanceled}
+	}
+
+	if resp.err != nil {
+		if _, ok := resp.err.(ErrorRejected); !ok {
+			log.WithFields(log.Fields{
+				"req":   req,
+				"error": resp.err,
+			}).Error("image fetch failed")
+			f.store.updateImageLogged(req.name, func(image *Image) {
+				image.Status = ImageStatusFailed
+				image.Error = resp.err.Error()
+			})
 		}
+	}
+	f.shareResponse(req.name, resp)
+}
 
-		if err := f.store.saveImage(image); err != nil {
-			fetchResp.err = err
+// cleanupCanceled removes the downloaded files and any partially received
+// dataset of a canceled fetch
+func (f *fetcher) cleanupCanceled(req *fetchRequest) {
+	filenames := []string{
+		filepath.Join(req.tempdir, req.name),
+		partialFilename(req.tempdir, req.name),
+		validatorFilename(req.tempdir, req.name),
+		diskFilename(req.tempdir, req.name),
+	}
+	for _, filename := range filenames {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"filename": filename,
+			}).Error("could not remove file of canceled fetch")
 		}
 	}
 
-	log.WithField("req", req).Debug("return response")
-	f.shareResponse(req.name, fetchResp)
+	destroyReceived(req)
+}
+
+// claimDest records whether the dataset an image is imported into is created
+// by the fetch, and so can be cleaned up by it
+func claimDest(req *fetchRequest) error {
+	_, err := zfs.GetDataset(req.dest)
+	if err != nil && !isZfsNotFound(err) {
+		return err
+	}
+	req.ownsDest = err != nil
+	return nil
+}
+
+// destroyReceived destroys the dataset an image was received into, if any. A
+// dataset that was already there before the fetch is left alone.
+func destroyReceived(req *fetchRequest) {
+	if !req.ownsDest {
+		return
+	}
+	ds, err := zfs.GetDataset(req.dest)
+	if err != nil {
+		if !isZfsNotFound(err) {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"dataset": req.dest,
+			}).Error("could not check for received dataset")
+		}
+		return
+	}
+	if err := ds.Destroy(zfs.DestroyRecursive); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"dataset": req.dest,
+		}).Error("could not destroy received dataset")
+	}
+}
+
+// fetching reports whether an image is being fetched
+func (f *fetcher) fetching(name string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.currentRequests[name]
+	return ok
 }
 
 // shareResponse shares a response with all similar waiting requests and then
@@ -268,6 +848,33 @@ func (f *fetcher) shareResponse(name string, resp *fetchResponse) {
 	}
 
 	delete(f.currentRequests, name)
+	delete(f.cancelChans, name)
+}
+
+// cancel aborts the fetch of an image and waits for it to stop. All requests
+// waiting on the fetch receive ErrCanceled. It returns false if the image
+// isn't being fetched.
+func (f *fetcher) cancel(name string) bool {
+	waiter := &fetchRequest{
+		name:     name,
+		response: make(chan *fetchResponse, 1),
+	}
+
+	f.lock.Lock()
+	cancel, ok := f.cancelChans[name]
+	if !ok {
+		f.lock.Unlock()
+		return false
+	}
+	if !isCanceled(cancel) {
+		log.WithField("image", name).Info("canceling image fetch")
+		close(cancel)
+	}
+	f.currentRequests[name] = append(f.currentRequests[name], waiter)
+	f.lock.Unlock()
+
+	<-waiter.response
+	return true
 }
 
 // process decides whether a request can share the response of an in-progress
@@ -276,6 +883,25 @@ func (f *fetcher) process(req *fetchRequest) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 
+	// The fetch either joins another or is queued below, so the room
+	// reserved for it isn't needed any more
+	f.releaseLocked(req)
+	if req.abandoned {
+		log.WithField("req", req).Debug("dropped abandoned request")
+		// Without another fetch under way, nothing will change the pending
+		// status the request left on the image, so it is recorded as
+		// canceled like a fetch canceled while queued
+		if _, ok := f.currentRequests[req.name]; !ok {
+			_ = f.store.updateExistingImage(req.name, func(image *Image) {
+				if image.Status == ImageStatusPending {
+					image.Status = ImageStatusFailed
+					image.Error = ErrCanceled.Error()
+				}
+			})
+		}
+		return
+	}
+
 	requests, ok := f.currentRequests[req.name]
 	if ok {
 		// A request for this already under way. Wait with the rest for a
@@ -286,16 +912,32 @@ func (f *fetcher) process(req *fetchRequest) {
 	}
 	// Completely new request
 	log.WithField("req", req).Debug("new request")
+	req.cancel = make(chan struct{})
 	f.currentRequests[req.name] = []*fetchRequest{req}
+	f.cancelChans[req.name] = req.cancel
+	f.queue.queued[req.name] = true
 	go f.fetchImage(req)
 }
 
-// fetch adds a new request to the fetcher
-func (f *fetcher) fetch(req *fetchRequest) *fetchResponse {
+// fetch adds a new request to the fetcher and waits for the response. If the
+// caller goes away first, the request is abandoned.
+func (f *fetcher) fetch(ctx context.Context, req *fetchRequest) *fetchResponse {
+	f.fetchAsync(req)
+	select {
+	case resp := <-req.response:
+		return resp
+	case <-ctx.Done():
+		f.abandon(req)
+		return &fetchResponse{err: ctx.Err()}
+	}
+}
+
+// fetchAsync adds a new request, which has been admitted, to the fetcher
+// without waiting for the response. The outcome is recorded on the image.
+func (f *fetcher) fetchAsync(req *fetchRequest) {
 	req.response = make(chan *fetchResponse, 1)
 	log.WithField("req", req).Debug("added to pending request chan")
 	f.pendingRequests <- req
-	return <-req.response
 }
 
 // run starts the processing of fetch requests
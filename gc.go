@@ -0,0 +1,294 @@
+package imagestore
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+const (
+	// defaultGCInterval is how often images are garbage collected when a
+	// cache size is configured without an interval
+	defaultGCInterval = 5 * time.Minute
+	// maxGCHistory is how many evictions are kept for GetGCHistory
+	maxGCHistory = 100
+)
+
+type (
+	// GCEviction is an image removed by the garbage collector
+	GCEviction struct {
+		ID        string    `json:"id"`
+		Size      uint64    `json:"size"` // bytes used by the image
+		LastUsed  time.Time `json:"lastUsed"`
+		EvictedAt time.Time `json:"evictedAt"`
+	}
+
+	// GCHistoryRequest is the request for GetGCHistory and CollectImages
+	GCHistoryRequest struct{}
+
+	// GCHistoryResponse is the response for GetGCHistory and CollectImages
+	GCHistoryResponse struct {
+		CacheSize uint64        `json:"cacheSize"` // 0 for unlimited
+		Used      uint64        `json:"used"`      // bytes used by images at the last collection
+		Evictions []*GCEviction `json:"evictions"` // most recent last
+	}
+
+	// collector evicts least recently used images when the images use more
+	// than the cache size
+	collector struct {
+		timeToDie chan struct{}
+		store     *ImageStore
+		cacheSize uint64
+		interval  time.Duration
+		lock      sync.Mutex
+		used      uint64
+		history   []*GCEviction
+		// images used since their last used times were last saved to
+		// their volumes
+		touchedImages map[string]bool
+
+		// held while collecting, so collections don't overlap
+		collecting sync.Mutex
+	}
+
+	// gcCandidate is an image and the space it uses
+	gcCandidate struct {
+		image *Image
+		size  uint64
+	}
+)
+
+func newCollector(store *ImageStore, cacheSize uint64, interval time.Duration) *collector {
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	return &collector{
+		timeToDie:     make(chan struct{}),
+		store:         store,
+		cacheSize:     cacheSize,
+		interval:      interval,
+		touchedImages: make(map[string]bool),
+	}
+}
+
+// Run collects garbage at startup and periodically, if a cache size is
+// configured. The last used times of images are saved to their volumes
+// periodically either way.
+func (c *collector) Run() {
+	go func() {
+		if c.cacheSize != 0 {
+			if err := c.collect(); err != nil {
+				log.WithField("error", err).Error("failed to garbage collect images")
+			}
+		}
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.timeToDie:
+				return
+			case <-ticker.C:
+				c.flushLastUsed()
+				if c.cacheSize == 0 {
+					continue
+				}
+				if err := c.collect(); err != nil {
+					log.WithField("error", err).Error("failed to garbage collect images")
+				}
+			}
+		}
+	}()
+}
+
+// Exit stops collecting garbage, saving the last used times that haven't been
+// yet
+func (c *collector) Exit() {
+	var q struct{}
+	c.timeToDie <- q
+	c.flushLastUsed()
+}
+
+// touched records that an image has been used since its last used time was
+// saved to its volume
+func (c *collector) touched(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.touchedImages[id] = true
+}
+
+// flushLastUsed saves the last used times of the images used since the last
+// flush to their volumes
+func (c *collector) flushLastUsed() {
+	c.lock.Lock()
+	ids := make([]string, 0, len(c.touchedImages))
+	for id := range c.touchedImages {
+		ids = append(ids, id)
+	}
+	c.touchedImages = make(map[string]bool)
+	c.lock.Unlock()
+
+	c.store.flushLastUsed(ids)
+}
+
+// collect evicts least recently used images until the images fit in the
+// cache size. Pinned images, images still being fetched and images that guest
+// disks or other clones depend on are never evicted. Nothing is evicted
+// without a cache size.
+func (c *collector) collect() error {
+	c.collecting.Lock()
+	defer c.collecting.Unlock()
+
+	images, err := c.store.listImages()
+	if err != nil {
+		return err
+	}
+
+	var used uint64
+	var candidates []*gcCandidate
+	for _, image := range images {
+		if image.Status != ImageStatusComplete || image.Volume == "" {
+			continue
+		}
+		ds, err := zfs.GetDataset(image.Volume)
+		if err != nil {
+			if isZfsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		used += ds.Used
+		if !image.Pinned {
+			candidates = append(candidates, &gcCandidate{image: image, size: ds.Used})
+		}
+	}
+	sort.Sort(byLastUsed(candidates))
+
+	for _, candidate := range candidates {
+		if c.cacheSize == 0 || used <= c.cacheSize {
+			break
+		}
+		image := candidate.image
+		dependents, err := c.store.imageDependents(image)
+		if err != nil {
+			return err
+		}
+		if len(dependents) > 0 {
+			continue
+		}
+		// A clone made since the dependents were listed makes the destroy
+		// fail, so an image can't be evicted from under a new clone
+		if err := c.store.destroyImage(image); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image.ID,
+			}).Warning("failed to evict image")
+			continue
+		}
+		used -= candidate.size
+		c.evicted(&GCEviction{
+			ID:        image.ID,
+			Size:      candidate.size,
+			LastUsed:  image.LastUsed,
+			EvictedAt: time.Now(),
+		})
+	}
+
+	c.lock.Lock()
+	c.used = used
+	c.lock.Unlock()
+	if c.cacheSize != 0 && used > c.cacheSize {
+		log.WithFields(log.Fields{
+			"used":      used,
+			"cacheSize": c.cacheSize,
+		}).Warning("images in use exceed the cache size")
+	}
+	return nil
+}
+
+// evicted records an eviction in the history
+func (c *collector) evicted(eviction *GCEviction) {
+	log.WithFields(log.Fields{
+		"image":    eviction.ID,
+		"size":     eviction.Size,
+		"lastUsed": eviction.LastUsed,
+	}).Info("evicted image")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.history = append(c.history, eviction)
+	if len(c.history) > maxGCHistory {
+		c.history = c.history[len(c.history)-maxGCHistory:]
+	}
+}
+
+type byLastUsed []*gcCandidate
+
+func (b byLastUsed) Len() int           { return len(b) }
+func (b byLastUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastUsed) Less(i, j int) bool { return b[i].image.LastUsed.Before(b[j].image.LastUsed) }
+
+// GetGCHistory lists the images recently evicted by the garbage collector
+func (store *ImageStore) GetGCHistory(r *http.Request, request *GCHistoryRequest, response *GCHistoryResponse) error {
+	store.collector.getHistory(response)
+	return nil
+}
+
+// CollectImages garbage collects images now instead of waiting for the next
+// collection, and lists the images recently evicted
+func (store *ImageStore) CollectImages(r *http.Request, request *GCHistoryRequest, response *GCHistoryResponse) error {
+	if err := store.collector.collect(); err != nil {
+		return err
+	}
+	store.collector.getHistory(response)
+	return nil
+}
+
+// getHistory copies the recent evictions into a response
+func (c *collector) getHistory(response *GCHistoryResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	evictions := make([]*GCEviction, len(c.history))
+	copy(evictions, c.history)
+	*response = GCHistoryResponse{
+		CacheSize: c.cacheSize,
+		Used:      c.used,
+		Evictions: evictions,
+	}
+}
+
+// PinImage keeps an image from being garbage collected
+func (store *ImageStore) PinImage(r *http.Request, request *rpc.ImageRequest, response *ImageResponse) error {
+	return store.setPinned(request.ID, true, response)
+}
+
+// UnpinImage lets an image be garbage collected again
+func (store *ImageStore) UnpinImage(r *http.Request, request *rpc.ImageRequest, response *ImageResponse) error {
+	return store.setPinned(request.ID, false, response)
+}
+
+func (store *ImageStore) setPinned(id string, pinned bool, response *ImageResponse) error {
+	if _, err := store.getImage(id); err != nil {
+		return err
+	}
+	if err := store.updateImage(id, func(image *Image) {
+		image.Pinned = pinned
+	}); err != nil {
+		return err
+	}
+	image, err := store.getImage(id)
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: []*Image{image},
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package imagestore_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+)
+
+type GCTestSuite struct {
+	APITestSuite
+}
+
+func TestGCTestSuite(t *testing.T) {
+	s := new(GCTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *GCTestSuite) configure(config *imagestore.Config) {
+	// Every image is over the cache size, so anything that can be evicted is
+	config.CacheSize = 1
+	// Collections are triggered by the test
+	config.GCInterval = time.Hour
+}
+
+func (s *GCTestSuite) TestCollect() {
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}))
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.PinImage", request, response))
+	if s.Len(response.Images, 1) {
+		s.True(response.Images[0].Pinned, "should pin the image")
+	}
+
+	cloned := &rpc.ImageRequest{ID: "gzipID", Dest: filepath.Join(s.ID, "guests", uuid.New())}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", cloned, &imagestore.ImageResponse{}))
+	s.NoError(s.Client.Do("ImageStore.CloneImage", cloned, &rpc.VolumeResponse{}))
+
+	unused := &rpc.ImageRequest{ID: "xzID"}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", unused, &imagestore.ImageResponse{}))
+
+	history := &imagestore.GCHistoryResponse{}
+	s.NoError(s.Client.Do("ImageStore.CollectImages", &imagestore.GCHistoryRequest{}, history))
+	if s.Len(history.Evictions, 1, "should evict only the unused image") {
+		s.Equal("xzID", history.Evictions[0].ID)
+		s.NotZero(history.Evictions[0].Size)
+	}
+	s.Equal(uint64(1), history.CacheSize)
+	s.NoError(s.Client.Do("ImageStore.GetGCHistory", &imagestore.GCHistoryRequest{}, history))
+	s.Len(history.Evictions, 1, "should keep the history")
+
+	s.Error(s.Client.Do("ImageStore.GetImage", unused, &imagestore.ImageResponse{}), "should delete the evicted image")
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, &imagestore.ImageResponse{}), "should keep the pinned image")
+
+	response = &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", cloned, response), "should keep the cloned image")
+	if s.Len(response.Images, 1) {
+		s.False(response.Images[0].LastUsed.IsZero(), "should record when the image was used")
+	}
+}
@@ -17,9 +17,15 @@ func (store *ImageStore) RunHTTP(port uint) *graceful.Server {
 	if err := s.RegisterService(store); err != nil {
 		log.WithField("error", err).Error("could not register snapshot download")
 	}
-	// Snapshot downloads are streaming application/octet-stream and can't be
-	// done through the normal RPC handling
+	// Snapshot downloads and uploads and disk exports are streaming
+	// application/octet-stream and can't be done through the normal RPC
+	// handling
 	s.HandleFunc("/snapshots/download", store.DownloadSnapshot)
+	s.HandleFunc("/snapshots/upload", store.UploadSnapshot)
+	s.HandleFunc("/disks/export", store.ExportDisk)
+	// Peer agents fetch images the same way as from an image server
+	s.HandleFunc("/images/{id}/download", store.ServeImage)
+	s.HandleFunc("/images/{id}/checksum", store.ServeImageChecksum)
 
 	server := &graceful.Server{
 		Timeout: 5 * time.Second,
@@ -0,0 +1,105 @@
+package imagestore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultConnectTimeout is used when no connect timeout is configured
+const defaultConnectTimeout = 30 * time.Second
+
+// HTTPConfig configures the http client used to fetch images
+type HTTPConfig struct {
+	CACert     string // PEM bundle of certificate authorities to trust, in addition to the system's
+	ClientCert string // PEM client certificate for mutual TLS
+	ClientKey  string // PEM key for the client certificate
+	// Credentials sent to http and https image sources and peer agents. Only
+	// one of a bearer token or basic auth may be used.
+	BearerToken       string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// ConnectTimeout limits establishing a connection and waiting for the
+	// response headers. DownloadTimeout limits the whole download, 0 for no
+	// limit.
+	ConnectTimeout  time.Duration
+	DownloadTimeout time.Duration
+	// MigrationTimeout limits sending a guest disk to a peer agent,
+	// defaultMigrationTimeout if 0
+	MigrationTimeout time.Duration
+}
+
+// newHTTPClient creates an http client for fetching images
+func newHTTPClient(config HTTPConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	connectTimeout := config.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		// Images are checksummed as served, so they must not be
+		// decompressed on the fly
+		DisableCompression:    true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: connectTimeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.DownloadTimeout,
+	}, nil
+}
+
+// authorizer returns a function that adds the configured credentials to a
+// request, or nil if there are none
+func (config HTTPConfig) authorizer() (func(*http.Request), error) {
+	switch {
+	case config.BearerToken != "" && config.BasicAuthUser != "":
+		return nil, errors.New("only one of a bearer token or basic auth may be configured")
+	case config.BearerToken != "":
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+config.BearerToken)
+		}, nil
+	case config.BasicAuthUser != "":
+		return func(r *http.Request) {
+			r.SetBasicAuth(config.BasicAuthUser, config.BasicAuthPassword)
+		}, nil
+	}
+	return nil, nil
+}
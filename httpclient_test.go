@@ -0,0 +1,80 @@
+package imagestore_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPClientTestSuite struct {
+	APITestSuite
+	SecureService *httptest.Server
+	CACertFile    string
+}
+
+func TestHTTPClientTestSuite(t *testing.T) {
+	s := new(HTTPClientTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *HTTPClientTestSuite) configure(config *imagestore.Config) {
+	// Set up a fake https image service that requires a bearer token
+	s.SecureService = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/images/"+s.ImageID+"/download" {
+			if _, err := w.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+		http.NotFound(w, r)
+	}))
+
+	// Trust the fake service's self signed certificate
+	caFile, err := ioutil.TempFile("", "HTTPClientTestSuite-")
+	s.Require().NoError(err)
+	defer logx.LogReturnedErr(caFile.Close, nil, "failed to close ca cert file")
+	s.Require().NoError(pem.Encode(caFile, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.SecureService.Certificate().Raw,
+	}))
+	s.CACertFile = caFile.Name()
+
+	secureURL, _ := url.Parse(s.SecureService.URL)
+	config.ImageServers = []string{"https://" + secureURL.Host}
+	config.HTTP = imagestore.HTTPConfig{
+		CACert:      s.CACertFile,
+		BearerToken: "secret",
+	}
+}
+
+func (s *HTTPClientTestSuite) TearDownSuite() {
+	s.SecureService.Close()
+	logx.LogReturnedErr(func() error { return os.Remove(s.CACertFile) },
+		nil, "unable to remove file "+s.CACertFile)
+}
+
+func (s *HTTPClientTestSuite) TestRequestImageTLS() {
+	response := &imagestore.ImageResponse{}
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: s.ImageID},
+	}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal(imagestore.ImageStatusComplete, response.Images[0].Status)
+	s.Equal(s.SecureService.URL+"/images/"+s.ImageID+"/download", response.Images[0].Source)
+}
@@ -3,18 +3,101 @@ package imagestore
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/kvite"
 	"github.com/mistifyio/mistify-agent/rpc"
-	netutil "github.com/mistifyio/util/net"
 	"gopkg.in/mistifyio/go-zfs.v1"
 )
 
+// Image statuses. An image moves from pending through downloading and
+// importing to complete, or ends up failed or rejected.
+const (
+	ImageStatusPending     = "pending"
+	ImageStatusDownloading = "downloading"
+	ImageStatusImporting   = "importing"
+	ImageStatusComplete    = "complete"
+	ImageStatusFailed      = "failed"
+	ImageStatusRejected    = "rejected"
+	ImageStatusMissing     = "missing" // datasets of a complete image are gone
+)
+
+type (
+	// Image is an image record as kept in the images bucket. It extends
+	// rpc.Image with metadata the agent tracks locally.
+	Image struct {
+		rpc.Image
+		Checksum   string `json:"checksum,omitempty"`   // sha256 of the fetched image
+		Verified   bool   `json:"verified"`             // signed by a key in the trust store
+		SigningKey string `json:"signingKey,omitempty"` // ID of the key the image was signed with
+		Error      string `json:"error,omitempty"`      // reason the fetch failed or the image was rejected
+		Source     string `json:"source,omitempty"`     // where the image was fetched from
+		Mirror     string `json:"mirror,omitempty"`     // image server the image was fetched from
+		// Download progress, in bytes
+		BytesDownloaded uint64 `json:"bytesDownloaded"`
+		TotalSize       uint64 `json:"totalSize"`
+		// Download attempts made by the latest fetch and the error of the
+		// last failed one, which may have been retried successfully
+		Attempts  int    `json:"attempts,omitempty"`
+		LastError string `json:"lastError,omitempty"`
+		// Compression format the image was fetched in
+		Compression string `json:"compression,omitempty"`
+		// Disk format the image was fetched in, a send stream, raw or qcow2
+		Format string `json:"format,omitempty"`
+		// sha256 of the zfs send stream of the image that peers are served.
+		// It is what was downloaded for an image fetched from a peer, and
+		// is otherwise computed the first time a peer asks for the image.
+		SendChecksum string `json:"sendChecksum,omitempty"`
+		// When the image was last cloned, or fetched if it hasn't been since.
+		// Least recently used images are garbage collected first.
+		LastUsed time.Time `json:"lastUsed"`
+		// Pinned images are never garbage collected
+		Pinned bool `json:"pinned,omitempty"`
+		// When the image was fetched
+		Fetched time.Time `json:"fetched"`
+		// Labels and aliases the image can be found by, and the history of
+		// changes to them
+		Labels  map[string]string `json:"labels,omitempty"`
+		Aliases []string          `json:"aliases,omitempty"`
+		History []*ImageEvent     `json:"history,omitempty"`
+	}
+
+	// ImageRequest is the request for image methods. It is compatible with
+	// rpc.ImageRequest.
+	ImageRequest struct {
+		rpc.ImageRequest
+		Async bool `json:"async"` // return without waiting for a fetch to finish
+		// Where to fetch the image from: the name of a configured source, a
+		// url under a configured source prefix, or empty for the image server
+		Source string `json:"source"`
+		// ImportModeStaged or ImportModeStream, or empty for the configured
+		// default. ImportModeStream isn't allowed with a trust store.
+		ImportMode string `json:"importMode"`
+		// DiskFormatRaw to import an image that isn't recognized as another
+		// format as a raw disk, even without a checksum to verify it with
+		Format string `json:"format"`
+	}
+
+	// ImageResponse is the response for image methods. It is compatible with
+	// rpc.ImageResponse.
+	ImageResponse struct {
+		Images []*Image `json:"images"`
+	}
+)
+
+// inProgress determines whether a fetch of the image is under way
+func (image *Image) inProgress() bool {
+	switch image.Status {
+	case ImageStatusPending, ImageStatusDownloading, ImageStatusImporting:
+		return true
+	}
+	return false
+}
+
 func isZfsNotFound(err error) bool {
 	if err == nil {
 		return false
@@ -29,11 +112,18 @@ func isZfsInvalid(err error) bool {
 	return strings.Contains(err.Error(), "invalid dataset name")
 }
 
-// RequestImage fetches an image
-func (store *ImageStore) RequestImage(r *http.Request, request *rpc.ImageRequest, response *rpc.ImageResponse) error {
+// RequestImage fetches an image. By default it waits for the fetch to finish.
+// An async request returns right away, and the progress of the fetch can be
+// followed with GetImage.
+func (store *ImageStore) RequestImage(r *http.Request, request *ImageRequest, response *ImageResponse) error {
 	if request.ID == "" {
 		return errors.New("need id")
 	}
+	id, err := store.resolveImage(request.ID)
+	if err != nil {
+		return err
+	}
+	request.ID = id
 
 	// Check whether it exists locally
 	image, err := store.getImage(request.ID)
@@ -42,21 +132,65 @@ func (store *ImageStore) RequestImage(r *http.Request, request *rpc.ImageRequest
 	}
 
 	// If it isn't here or ready, go get it
-	if image == nil || image.Status != "complete" {
-		hostport, err := netutil.HostWithPort(store.config.ImageServer)
+	if image == nil || image.Status != ImageStatusComplete {
+		locations, err := store.sourceLocations(request.ID, request.Source)
 		if err != nil {
 			return err
 		}
+		importMode := request.ImportMode
+		if importMode == "" {
+			importMode = store.config.ImportMode
+		}
+		if importMode != "" && importMode != ImportModeStaged && importMode != ImportModeStream {
+			return ErrInvalidImportMode
+		}
+		// Signatures are checked before an image is received, which only a
+		// staged import can do
+		if importMode == ImportModeStream && store.trustStore != nil {
+			return ErrStreamNotVerified
+		}
+		if request.Format != "" && request.Format != DiskFormatRaw {
+			return errors.New("invalid format")
+		}
 		req := &fetchRequest{
-			name:    request.ID,
-			source:  fmt.Sprintf("http://%s/images/%s/download", hostport, request.ID),
-			tempdir: store.tempDir,
-			dest:    filepath.Join(store.dataset, request.ID),
+			name:      request.ID,
+			locations: locations,
+			tempdir:   store.tempDir,
+			dest:      filepath.Join(store.dataset, request.ID),
+			stream:    importMode == ImportModeStream,
+			format:    request.Format,
 		}
 
-		resp := store.fetcher.fetch(req)
-		if resp.err != nil {
-			return resp.err
+		// New fetches are turned away when too many are waiting to start
+		if err := store.fetcher.admit(r.Context(), req); err != nil {
+			return err
+		}
+
+		// A fetch that is already under way keeps its progress
+		if image == nil || !image.inProgress() {
+			err := store.updateImage(request.ID, func(image *Image) {
+				image.Status = ImageStatusPending
+				image.Source = locations[0].source
+				image.Mirror = locations[0].mirror
+				image.Error = ""
+				image.BytesDownloaded = 0
+				image.TotalSize = 0
+				image.Attempts = 0
+				image.LastError = ""
+			})
+			if err != nil {
+				store.fetcher.release(req)
+				return err
+			}
+		}
+
+		if request.Async {
+			store.fetcher.fetchAsync(req)
+		} else {
+			resp := store.fetcher.fetch(r.Context(), req)
+			if resp.err != nil {
+				return resp.err
+			}
 		}
 
 		// Get the image data
@@ -66,17 +200,51 @@ func (store *ImageStore) RequestImage(r *http.Request, request *rpc.ImageRequest
 		}
 	}
 
-	*response = rpc.ImageResponse{
-		Images: []*rpc.Image{
+	*response = ImageResponse{
+		Images: []*Image{
 			image,
 		},
 	}
 	return nil
 }
 
+// CancelImageRequest aborts the fetch of an image. Every request waiting on
+// the fetch fails and anything downloaded or imported so far is removed.
+func (store *ImageStore) CancelImageRequest(r *http.Request, request *rpc.ImageRequest, response *ImageResponse) error {
+	if request.ID == "" {
+		return errors.New("need id")
+	}
+
+	if !store.fetcher.cancel(request.ID) {
+		return ErrNotFound
+	}
+
+	image, err := store.getImage(request.ID)
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: []*Image{image},
+	}
+	return nil
+}
+
 // ListImages lists the disk images
-func (store *ImageStore) ListImages(r *http.Request, request *rpc.ImageRequest, response *rpc.ImageResponse) error {
-	var images []*rpc.Image
+func (store *ImageStore) ListImages(r *http.Request, request *rpc.ImageRequest, response *ImageResponse) error {
+	images, err := store.listImages()
+	if err != nil {
+		return err
+	}
+	*response = ImageResponse{
+		Images: images,
+	}
+	return nil
+}
+
+// listImages gets all image records
+func (store *ImageStore) listImages() ([]*Image, error) {
+	var images []*Image
 
 	err := store.DB.Transaction(func(tx *kvite.Tx) error {
 		if b, err := tx.Bucket("images"); b != nil {
@@ -84,7 +252,7 @@ func (store *ImageStore) ListImages(r *http.Request, request *rpc.ImageRequest,
 				return err
 			}
 			err = b.ForEach(func(k string, v []byte) error {
-				var i rpc.Image
+				var i Image
 				if err := json.Unmarshal(v, &i); err != nil {
 					return err
 				}
@@ -100,17 +268,14 @@ func (store *ImageStore) ListImages(r *http.Request, request *rpc.ImageRequest,
 	})
 
 	if err != nil {
-		return err
-	}
-	*response = rpc.ImageResponse{
-		Images: images,
+		return nil, err
 	}
-	return nil
+	return images, nil
 }
 
 // GetImage gets a disk image
-func (store *ImageStore) GetImage(r *http.Request, request *rpc.ImageRequest, response *rpc.ImageResponse) error {
-	var images []*rpc.Image
+func (store *ImageStore) GetImage(r *http.Request, request *rpc.ImageRequest, response *ImageResponse) error {
+	var images []*Image
 	image, err := store.getImage(request.ID)
 	if err != nil {
 		return err
@@ -118,19 +283,47 @@ func (store *ImageStore) GetImage(r *http.Request, request *rpc.ImageRequest, re
 	images = append(images, image)
 
 	// not found is an empty slice
-	*response = rpc.ImageResponse{
+	*response = ImageResponse{
 		Images: images,
 	}
 	return nil
 }
 
-// DeleteImage deletes a disk image
-func (store *ImageStore) DeleteImage(r *http.Request, request *rpc.ImageRequest, response *rpc.ImageResponse) error {
+// DeleteImage deletes a disk image. Images that guest disks or other clones
+// depend on are not deleted unless the clones are to be promoted or destroyed,
+// and the clones are listed in the response as well as the error.
+func (store *ImageStore) DeleteImage(r *http.Request, request *DeleteImageRequest, response *DeleteImageResponse) error {
 	image, err := store.getImage(request.ID)
 	if err != nil {
 		return err
 	}
-	for _, name := range []string{image.Snapshot, image.Volume} {
+	if err := store.releaseDependents(image, request); err != nil {
+		if inUse, ok := err.(ErrorInUse); ok {
+			*response = DeleteImageResponse{
+				Dependents: inUse.Dependents,
+			}
+		}
+		return err
+	}
+	if err := store.destroyImage(image); err != nil {
+		return err
+	}
+
+	*response = DeleteImageResponse{
+		ImageResponse: ImageResponse{
+			Images: []*Image{image},
+		},
+	}
+	return nil
+}
+
+// destroyImage destroys the datasets of an image and removes its record
+func (store *ImageStore) destroyImage(image *Image) error {
+	store.sendHasher.cancel(image.ID)
+
+	// The volume and its snapshot are destroyed together so a failure can't
+	// leave one without the other
+	for _, name := range []string{image.Volume, image.Snapshot} {
 		if name != "" {
 			d, err := zfs.GetDataset(name)
 
@@ -138,30 +331,33 @@ func (store *ImageStore) DeleteImage(r *http.Request, request *rpc.ImageRequest,
 				if err != nil {
 					return err
 				}
-				if err := d.Destroy(false); err != nil {
+				if err := d.Destroy(true); err != nil {
 					return err
 				}
+				break
 			}
 		}
 	}
 
-	err = store.DB.Transaction(func(tx *kvite.Tx) error {
+	return store.DB.Transaction(func(tx *kvite.Tx) error {
+		if b, err := tx.Bucket("aliases"); b != nil {
+			if err != nil {
+				return err
+			}
+			for _, alias := range image.Aliases {
+				if err := b.Delete(alias); err != nil {
+					return err
+				}
+			}
+		}
 		if b, err := tx.Bucket("images"); b != nil {
 			if err != nil {
 				return err
 			}
-			return b.Delete(request.ID)
+			return b.Delete(image.ID)
 		}
 		return nil
 	})
-	if err != nil {
-		return err
-	}
-
-	*response = rpc.ImageResponse{
-		Images: []*rpc.Image{image},
-	}
-	return nil
 }
 
 // CloneImage clones a disk image
@@ -171,7 +367,11 @@ func (store *ImageStore) CloneImage(r *http.Request, request *rpc.ImageRequest,
 		return errors.New("need dest")
 	}
 
-	image, err := store.getImage(request.ID)
+	id, err := store.resolveImage(request.ID)
+	if err != nil {
+		return err
+	}
+	image, err := store.getReadyImage(id)
 	if err != nil {
 		return err
 	}
@@ -185,6 +385,7 @@ func (store *ImageStore) CloneImage(r *http.Request, request *rpc.ImageRequest,
 	if err != nil {
 		return err
 	}
+	store.touchImage(image.ID)
 
 	vol := volumeFromDataset(clone)
 
@@ -199,9 +400,13 @@ func (store *ImageStore) RequestClone(name, dest string) (*zfs.Dataset, error) {
 
 	log.WithField("RequestClone", dest).Info()
 
-	i := &rpc.Image{}
+	id, err := store.resolveImage(name)
+	if err != nil {
+		return nil, err
+	}
+	i := &Image{}
 
-	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+	err = store.DB.Transaction(func(tx *kvite.Tx) error {
 		b, err := tx.Bucket("images")
 		if err != nil {
 			return err
@@ -209,7 +414,7 @@ func (store *ImageStore) RequestClone(name, dest string) (*zfs.Dataset, error) {
 		if b == nil {
 			return ErrNotFound
 		}
-		v, err := b.Get(name)
+		v, err := b.Get(id)
 		if err != nil {
 			return err
 		}
@@ -222,12 +427,20 @@ func (store *ImageStore) RequestClone(name, dest string) (*zfs.Dataset, error) {
 	if err != nil {
 		return nil, err
 	}
+	if i.Status != ImageStatusComplete {
+		return nil, ErrNotReady
+	}
 
-	return store.cloneWorker.Clone(i.Snapshot, dest)
+	ds, err := store.cloneWorker.Clone(i.Snapshot, dest)
+	if err != nil {
+		return nil, err
+	}
+	store.touchImage(id)
+	return ds, nil
 }
 
-func (store *ImageStore) getImage(id string) (*rpc.Image, error) {
-	var image rpc.Image
+func (store *ImageStore) getImage(id string) (*Image, error) {
+	var image Image
 	err := store.DB.Transaction(func(tx *kvite.Tx) error {
 		if b, err := tx.Bucket("images"); b != nil {
 			if err != nil {
@@ -253,25 +466,135 @@ func (store *ImageStore) getImage(id string) (*rpc.Image, error) {
 	return &image, nil
 }
 
-func (store *ImageStore) saveImage(image *rpc.Image) error {
-	val, err := json.Marshal(image)
+// getReadyImage gets an image that has been completely fetched and can be
+// cloned
+func (store *ImageStore) getReadyImage(id string) (*Image, error) {
+	image, err := store.getImage(id)
+	if err != nil {
+		return nil, err
+	}
+	if image.Status != ImageStatusComplete {
+		return nil, ErrNotReady
+	}
+	return image, nil
+}
+
+// updateImage modifies an image record, creating it if needed, in a single
+// transaction
+func (store *ImageStore) updateImage(id string, update func(*Image)) error {
+	return store.updateImageRecord(id, true, update)
+}
+
+// updateExistingImage modifies an image record like updateImage, but leaves
+// an image whose record is gone alone, such as one deleted or evicted while
+// it was in use
+func (store *ImageStore) updateExistingImage(id string, update func(*Image)) error {
+	return store.updateImageRecord(id, false, update)
+}
+
+// updateImageRecord modifies an image record in a single transaction,
+// creating it if it doesn't exist and create is set
+func (store *ImageStore) updateImageRecord(id string, create bool, update func(*Image)) error {
+	unlock := store.imageLocks.acquire(id)
+	defer unlock()
+
+	var saved *Image
+	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.CreateBucketIfNotExists("images")
+		if err != nil {
+			return err
+		}
+		image := &Image{}
+		v, err := b.Get(id)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			if err := json.Unmarshal(v, image); err != nil {
+				return err
+			}
+		} else if !create {
+			return nil
+		}
+		image.ID = id
+		before := imagePropertyValues(image)
+		update(image)
+		if image.Volume != "" && propertiesChanged(before, imagePropertyValues(image)) {
+			saved = image
+		}
+
+		val, err := json.Marshal(image)
+		if err != nil {
+			return err
+		}
+		return b.Put(id, val)
+	})
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-			"func":  "json.Marshal",
-		}).Error("failed to marshal image")
+			"image": id,
+		}).Error("failed to update image data")
 		return err
 	}
 
-	err = store.DB.Transaction(func(tx *kvite.Tx) error {
-		b, err := tx.CreateBucketIfNotExists("images")
-		if err != nil {
+	// Keep the metadata on the volume too, so the record can be rebuilt if
+	// it is lost
+	if saved != nil {
+		saveImageProperties(saved)
+	}
+	return nil
+}
+
+// touchImage records that an image was just used. The collector saves the
+// time to the volume later.
+func (store *ImageStore) touchImage(id string) {
+	if err := store.updateExistingImage(id, func(image *Image) {
+		image.LastUsed = time.Now()
+	}); err == nil {
+		store.collector.touched(id)
+	}
+}
+
+// updateImageLogged updates an image record where a failure to do so isn't
+// worth failing the calling operation over. The error is logged by
+// updateImage.
+func (store *ImageStore) updateImageLogged(id string, update func(*Image)) {
+	_ = store.updateImage(id, update)
+}
+
+// failInterruptedFetches marks images that were still being fetched when the
+// agent stopped as failed, so they are fetched again when requested
+func (store *ImageStore) failInterruptedFetches() error {
+	var interrupted []string
+	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil || b == nil {
 			return err
 		}
-		return b.Put(image.ID, val)
+		return b.ForEach(func(k string, v []byte) error {
+			var image Image
+			if err := json.Unmarshal(v, &image); err != nil {
+				return err
+			}
+			if image.inProgress() {
+				interrupted = append(interrupted, image.ID)
+			}
+			return nil
+		})
 	})
 	if err != nil {
-		log.WithField("error", err).Error("failed to save image data")
+		return err
 	}
-	return err
+
+	for _, id := range interrupted {
+		log.WithField("image", id).Warning("image fetch was interrupted")
+		err := store.updateImage(id, func(image *Image) {
+			image.Status = ImageStatusFailed
+			image.Error = "fetch interrupted by agent restart"
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,9 +1,18 @@
 package imagestore_test
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/mistifyio/go-zfs"
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/client"
 	"github.com/mistifyio/mistify-agent/rpc"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
@@ -60,11 +69,158 @@ func (s *ImageTestSuite) TestRequestImage() {
 			&rpc.ImageRequest{ID: s.ImageID}, false},
 		{"gzipped image",
 			&rpc.ImageRequest{ID: "gzipID"}, false},
+		{"xz image",
+			&rpc.ImageRequest{ID: "xzID"}, false},
+		{"zstd image",
+			&rpc.ImageRequest{ID: "zstdID"}, false},
+		{"checksum mismatch",
+			&rpc.ImageRequest{ID: "badChecksumID"}, true},
 	}
 
 	s.runTestCases("RequestImage", tests)
 }
 
+func (s *ImageTestSuite) TestRequestImageCompression() {
+	tests := map[string]string{
+		s.ImageID: imagestore.CompressionNone,
+		"gzipID":  imagestore.CompressionGzip,
+		"xzID":    imagestore.CompressionXz,
+		"zstdID":  imagestore.CompressionZstd,
+	}
+
+	for id, compression := range tests {
+		response := &imagestore.ImageResponse{}
+		s.NoError(s.Client.Do("ImageStore.RequestImage", &rpc.ImageRequest{ID: id}, response), id)
+		s.Len(response.Images, 1, id)
+		s.Equal(compression, response.Images[0].Compression, id)
+	}
+}
+
+func (s *ImageTestSuite) TestRequestImageStream() {
+	tests := []struct {
+		description string
+		id          string
+		mode        string
+		expectedErr bool
+	}{
+		{"valid id", s.ImageID, imagestore.ImportModeStream, false},
+		{"gzipped image", "gzipID", imagestore.ImportModeStream, false},
+		{"checksum mismatch", "badChecksumID", imagestore.ImportModeStream, true},
+		{"invalid mode", s.ImageID, "asdf", true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		request := &imagestore.ImageRequest{
+			ImageRequest: rpc.ImageRequest{ID: test.id},
+			ImportMode:   test.mode,
+		}
+		response := &imagestore.ImageResponse{}
+		err := s.Client.Do("ImageStore.RequestImage", request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should error"))
+			_, err := zfs.GetDataset(filepath.Join(s.ID, "images", test.id))
+			s.Error(err, msg("should not leave a received dataset"))
+			continue
+		}
+		s.NoError(err, msg("should not error"))
+		s.Len(response.Images, 1, msg("should return the image"))
+		s.Equal(imagestore.ImageStatusComplete, response.Images[0].Status, msg("should be complete"))
+		s.NotEmpty(response.Images[0].Checksum, msg("should record the checksum"))
+
+		s.NoError(s.Client.Do("ImageStore.DeleteImage", &rpc.ImageRequest{ID: test.id}, &imagestore.ImageResponse{}), msg("should delete"))
+	}
+}
+
+func (s *ImageTestSuite) TestRequestImageExistingDest() {
+	// A dataset that is in the way of the fetch isn't the fetch's to destroy
+	dest := filepath.Join(s.ID, "images", s.ImageID)
+	_, err := zfs.CreateFilesystem(dest, defaultZFSOptions)
+	s.Require().NoError(err)
+
+	for _, mode := range []string{imagestore.ImportModeStaged, imagestore.ImportModeStream} {
+		msg := testMsgFunc(mode)
+		request := &imagestore.ImageRequest{
+			ImageRequest: rpc.ImageRequest{ID: s.ImageID},
+			ImportMode:   mode,
+		}
+		s.Error(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}), msg("should error"))
+		_, err := zfs.GetDataset(dest)
+		s.NoError(err, msg("should leave the existing dataset"))
+	}
+}
+
+func (s *ImageTestSuite) TestRequestImageResume() {
+	request := &rpc.ImageRequest{ID: "resumeID"}
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal("complete", response.Images[0].Status)
+	s.Equal(int32(1), atomic.LoadInt32(&s.ResumedDownloads), "retry should resume the download")
+	s.Equal(2, response.Images[0].Attempts)
+	s.Equal(io.ErrUnexpectedEOF.Error(), response.Images[0].LastError)
+}
+
+func (s *ImageTestSuite) TestRequestImageRetry() {
+	request := &rpc.ImageRequest{ID: "flakyID"}
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response), "transient failure should be retried")
+	s.Len(response.Images, 1)
+	s.Equal(imagestore.ImageStatusComplete, response.Images[0].Status)
+	s.Equal(2, response.Images[0].Attempts)
+	s.Contains(response.Images[0].LastError, "503")
+}
+
+func (s *ImageTestSuite) TestRequestImageAsync() {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: s.ImageID},
+		Async:        true,
+	}
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Len(response.Images, 1)
+
+	image := s.waitForImage(s.ImageID)
+	s.Equal(imagestore.ImageStatusComplete, image.Status)
+	s.Equal(uint64(len(s.ImageData)), image.BytesDownloaded)
+	s.Equal(uint64(len(s.ImageData)), image.TotalSize)
+
+	request.ID = "asdf"
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response), "async request shouldn't wait for the failure")
+	image = s.waitForImage("asdf")
+	s.Equal(imagestore.ImageStatusFailed, image.Status)
+	s.NotEmpty(image.Error)
+}
+
+func (s *ImageTestSuite) TestCancelImageRequest() {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: "slowID"},
+		Async:        true,
+	}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}))
+
+	// Wait for the download to start
+	for i := 0; i < 100; i++ {
+		response := &imagestore.ImageResponse{}
+		s.NoError(s.Client.Do("ImageStore.GetImage", request, response))
+		if response.Images[0].Status == imagestore.ImageStatusDownloading {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.CancelImageRequest", request, response))
+	s.Len(response.Images, 1)
+	s.Equal(imagestore.ImageStatusFailed, response.Images[0].Status)
+	s.Equal(imagestore.ErrCanceled.Error(), response.Images[0].Error)
+
+	_, err := os.Stat(filepath.Join("/", s.ID, "images", "temp", "slowID.partial"))
+	s.True(os.IsNotExist(err), "partial download should be removed")
+
+	s.Error(s.Client.Do("ImageStore.CancelImageRequest", request, response), "nothing left to cancel")
+}
+
 func (s *ImageTestSuite) TestListImages() {
 	response := &rpc.ImageResponse{}
 	request := &rpc.ImageRequest{}
@@ -80,6 +236,12 @@ func (s *ImageTestSuite) TestGetImage() {
 	s.fetchImage()
 
 	s.runTestCases("GetImage", nil)
+
+	response := &imagestore.ImageResponse{}
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal(fmt.Sprintf("sha256:%x", sha256.Sum256(s.ImageData)), response.Images[0].Checksum)
 }
 
 func (s *ImageTestSuite) TestDeleteImage() {
@@ -88,6 +250,54 @@ func (s *ImageTestSuite) TestDeleteImage() {
 	s.runTestCases("DeleteImage", nil)
 }
 
+func (s *ImageTestSuite) TestDeleteImageInUse() {
+	tests := []struct {
+		description string
+		force       bool
+		promote     bool
+		keepsClone  bool
+	}{
+		{"promote", false, true, true},
+		{"force", true, false, false},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		image := s.fetchImage()
+		dest := filepath.Join(filepath.Dir(image.Volume), uuid.New())
+		clone := &rpc.ImageRequest{ID: s.ImageID, Dest: dest}
+		s.NoError(s.Client.Do("ImageStore.CloneImage", clone, &rpc.VolumeResponse{}), msg("should clone"))
+
+		dependents := &imagestore.ImageDependentsResponse{}
+		request := &rpc.ImageRequest{ID: s.ImageID}
+		s.NoError(s.Client.Do("ImageStore.GetImageDependents", request, dependents), msg("should not error"))
+		s.Equal([]string{dest}, dependents.Dependents, msg("should list the clone"))
+
+		err := s.Client.Do("ImageStore.DeleteImage", request, &imagestore.ImageResponse{})
+		if s.Error(err, msg("should refuse to delete an image in use")) {
+			s.Contains(err.Error(), imagestore.ErrorInUse{ID: s.ImageID, Dependents: []string{dest}}.Error(), msg("should list the dependents"))
+		}
+		deleted := &imagestore.DeleteImageResponse{}
+		s.Error(s.Store.DeleteImage(nil, &imagestore.DeleteImageRequest{ImageRequest: *request}, deleted), msg("should refuse to delete an image in use"))
+		s.Equal([]string{dest}, deleted.Dependents, msg("should return the dependents"))
+		s.NoError(s.Client.Do("ImageStore.GetImage", request, &imagestore.ImageResponse{}), msg("should keep the image"))
+
+		both := &imagestore.DeleteImageRequest{ImageRequest: *request, Force: true, Promote: true}
+		s.Error(s.Client.Do("ImageStore.DeleteImage", both, &imagestore.ImageResponse{}), msg("should not both force and promote"))
+
+		del := &imagestore.DeleteImageRequest{ImageRequest: *request, Force: test.force, Promote: test.promote}
+		s.NoError(s.Client.Do("ImageStore.DeleteImage", del, &imagestore.ImageResponse{}), msg("should delete"))
+		s.Error(s.Client.Do("ImageStore.GetImage", request, &imagestore.ImageResponse{}), msg("should delete the record"))
+		_, err = zfs.GetDataset(image.Volume)
+		s.Error(err, msg("should destroy the image volume"))
+		cloned, err := zfs.GetDataset(dest)
+		s.Equal(test.keepsClone, err == nil, msg("should keep or destroy the clone"))
+		if cloned != nil {
+			s.NoError(cloned.Destroy(zfs.DestroyRecursive))
+		}
+	}
+}
+
 // TODO: Sort out the clone functionality and then test it better
 func (s *ImageTestSuite) TestCloneImage() {
 	image := s.fetchImage()
@@ -126,6 +336,9 @@ func (s *ImageTestSuite) TestCloneImage() {
 func (s *ImageTestSuite) TestRequestClone() {
 	image := s.fetchImage()
 	dest := filepath.Join(filepath.Dir(image.Volume), uuid.New())
+	aliasDest := filepath.Join(filepath.Dir(image.Volume), uuid.New())
+	alias := &imagestore.AliasRequest{ID: s.ImageID, Alias: "clone-alias"}
+	s.NoError(s.Client.Do("ImageStore.SetImageAlias", alias, &imagestore.ImageResponse{}))
 
 	tests := []struct {
 		description string
@@ -141,6 +354,8 @@ func (s *ImageTestSuite) TestRequestClone() {
 			"asdf", dest, true},
 		{"valid id",
 			s.ImageID, dest, false},
+		{"alias",
+			"clone-alias", aliasDest, false},
 	}
 
 	for _, test := range tests {
@@ -148,9 +363,95 @@ func (s *ImageTestSuite) TestRequestClone() {
 		if test.expectedErr {
 			s.Error(err)
 			s.Nil(dataset)
-		} else {
-			s.NoError(err)
-			s.Equal(dest, dataset.Name)
+		} else if s.NoError(err) {
+			s.Equal(test.dest, dataset.Name)
+		}
+	}
+	s.NoError(s.Client.Do("ImageStore.RemoveImageAlias", &imagestore.AliasRequest{Alias: "clone-alias"}, &imagestore.ImageResponse{}))
+}
+
+func (s *ImageTestSuite) TestImageLabels() {
+	s.fetchImage()
+
+	labels := &imagestore.LabelsRequest{ID: s.ImageID, Labels: map[string]string{"os": "ubuntu", "version": "24.04"}}
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.SetImageLabels", labels, response))
+	if s.Len(response.Images, 1) {
+		s.Equal(labels.Labels, response.Images[0].Labels)
+	}
+
+	remove := &imagestore.LabelsRequest{ID: s.ImageID, Keys: []string{"version"}}
+	s.NoError(s.Client.Do("ImageStore.RemoveImageLabels", remove, response))
+	if s.Len(response.Images, 1) {
+		s.Equal(map[string]string{"os": "ubuntu"}, response.Images[0].Labels)
+		history := response.Images[0].History
+		if s.Len(history, 2) {
+			s.Equal(imagestore.ImageEventLabel, history[0].Event)
+			s.Equal("os=ubuntu, version=24.04", history[0].Detail)
+			s.Equal(imagestore.ImageEventUnlabel, history[1].Event)
 		}
 	}
+
+	s.Error(s.Client.Do("ImageStore.SetImageLabels", &imagestore.LabelsRequest{ID: "asdf", Labels: labels.Labels}, response), "should need an image")
+	s.Error(s.Client.Do("ImageStore.SetImageLabels", &imagestore.LabelsRequest{ID: s.ImageID}, response), "should need labels")
+}
+
+func (s *ImageTestSuite) TestImageAliases() {
+	s.fetchImage()
+	other := &imagestore.ImageRequest{ImageRequest: rpc.ImageRequest{ID: "gzipID"}}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", other, &imagestore.ImageResponse{}))
+
+	alias := &imagestore.AliasRequest{ID: s.ImageID, Alias: "ubuntu-latest"}
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.SetImageAlias", alias, response))
+	if s.Len(response.Images, 1) {
+		s.Equal([]string{"ubuntu-latest"}, response.Images[0].Aliases)
+	}
+	s.Error(s.Client.Do("ImageStore.SetImageAlias", &imagestore.AliasRequest{ID: s.ImageID, Alias: "gzipID"}, response), "should not alias an image id")
+
+	// Aliases resolve to the image they point at
+	clone := &rpc.ImageRequest{ID: "ubuntu-latest", Dest: filepath.Join(s.ID, "guests", uuid.New())}
+	s.NoError(s.Client.Do("ImageStore.CloneImage", clone, &rpc.VolumeResponse{}), "should clone by alias")
+
+	// Move the alias
+	alias.ID = "gzipID"
+	s.NoError(s.Client.Do("ImageStore.SetImageAlias", alias, response))
+	if s.Len(response.Images, 1) {
+		s.Equal("gzipID", response.Images[0].ID)
+		history := response.Images[0].History
+		if s.Len(history, 1) {
+			s.Equal(imagestore.ImageEventAlias, history[0].Event)
+			s.Equal("ubuntu-latest moved from "+s.ImageID, history[0].Detail)
+		}
+	}
+	s.NoError(s.Client.Do("ImageStore.GetImage", &rpc.ImageRequest{ID: s.ImageID}, response))
+	if s.Len(response.Images, 1) {
+		s.Empty(response.Images[0].Aliases, "should move the alias away")
+		history := response.Images[0].History
+		if s.Len(history, 2) {
+			s.Equal(imagestore.ImageEventUnalias, history[1].Event)
+		}
+	}
+
+	request := &imagestore.ImageRequest{ImageRequest: rpc.ImageRequest{ID: "ubuntu-latest"}}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	if s.Len(response.Images, 1) {
+		s.Equal("gzipID", response.Images[0].ID, "should request the image the alias points at")
+	}
+
+	guest := &client.Guest{ID: uuid.New(), Disks: []client.Disk{{Image: "ubuntu-latest"}}}
+	guestResponse := &rpc.GuestResponse{}
+	s.NoError(s.Client.Do("ImageStore.VerifyDisks", &rpc.GuestRequest{Guest: guest}, guestResponse))
+	if s.NotNil(guestResponse.Guest) {
+		s.Equal("gzipID", guestResponse.Guest.Disks[0].Image, "should resolve the alias of a disk")
+	}
+
+	remove := &imagestore.AliasRequest{Alias: "ubuntu-latest"}
+	s.NoError(s.Client.Do("ImageStore.RemoveImageAlias", remove, response))
+	if s.Len(response.Images, 1) {
+		s.Empty(response.Images[0].Aliases)
+	}
+	s.Error(s.Client.Do("ImageStore.RemoveImageAlias", remove, response), "should not remove an alias twice")
+	clone.Dest = filepath.Join(s.ID, "guests", uuid.New())
+	s.Error(s.Client.Do("ImageStore.CloneImage", clone, &rpc.VolumeResponse{}), "should not resolve a removed alias")
 }
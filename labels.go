@@ -0,0 +1,344 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/kvite"
+)
+
+// Image history events
+const (
+	ImageEventLabel   = "label"   // labels set
+	ImageEventUnlabel = "unlabel" // labels removed
+	ImageEventAlias   = "alias"   // alias added, or moved from another image
+	ImageEventUnalias = "unalias" // alias removed, or moved to another image
+)
+
+// maxImageHistory is how many events are kept in the history of an image
+const maxImageHistory = 50
+
+type (
+	// ImageEvent is a change to the labels or aliases of an image
+	ImageEvent struct {
+		Time   time.Time `json:"time"`
+		Event  string    `json:"event"`
+		Detail string    `json:"detail,omitempty"`
+	}
+
+	// LabelsRequest is the request for SetImageLabels and RemoveImageLabels
+	LabelsRequest struct {
+		ID     string            `json:"id"`     // image ID or alias
+		Labels map[string]string `json:"labels"` // labels to set
+		Keys   []string          `json:"keys"`   // labels to remove
+	}
+
+	// AliasRequest is the request for SetImageAlias and RemoveImageAlias
+	AliasRequest struct {
+		ID    string `json:"id"` // image ID or alias, not needed to remove an alias
+		Alias string `json:"alias"`
+	}
+)
+
+// addEvent records an event in the history of an image, dropping the oldest
+// events past the limit
+func (image *Image) addEvent(event, detail string) {
+	image.History = append(image.History, &ImageEvent{
+		Time:   time.Now(),
+		Event:  event,
+		Detail: detail,
+	})
+	if len(image.History) > maxImageHistory {
+		image.History = image.History[len(image.History)-maxImageHistory:]
+	}
+}
+
+// removeAlias removes an alias from an image
+func (image *Image) removeAlias(alias string) {
+	for i, a := range image.Aliases {
+		if a == alias {
+			image.Aliases = append(image.Aliases[:i], image.Aliases[i+1:]...)
+			return
+		}
+	}
+}
+
+// getImageTx gets an image record in a transaction
+func getImageTx(b *kvite.Bucket, id string) (*Image, error) {
+	v, err := b.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	image := &Image{}
+	if err := json.Unmarshal(v, image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// putImageTx saves an image record in a transaction
+func putImageTx(b *kvite.Bucket, image *Image) error {
+	v, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+	return b.Put(image.ID, v)
+}
+
+// resolveImage gets the ID of an image from its ID or one of its aliases. IDs
+// take precedence, and names that are neither are returned as they are.
+func (store *ImageStore) resolveImage(name string) (string, error) {
+	id := name
+	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+		images, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		if images != nil {
+			v, err := images.Get(name)
+			if err != nil || v != nil {
+				return err
+			}
+		}
+		aliases, err := tx.Bucket("aliases")
+		if err != nil || aliases == nil {
+			return err
+		}
+		v, err := aliases.Get(name)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			id = string(v)
+		}
+		return nil
+	})
+	return id, err
+}
+
+// updateLabels changes the labels of an image, returning the updated image
+func (store *ImageStore) updateLabels(name string, set map[string]string, remove []string) (*Image, error) {
+	id, err := store.resolveImage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := store.imageLocks.acquire(id)
+	defer unlock()
+
+	var image *Image
+	err = store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.CreateBucketIfNotExists("images")
+		if err != nil {
+			return err
+		}
+		image, err = getImageTx(b, id)
+		if err != nil {
+			return err
+		}
+
+		var changed []string
+		for key, value := range set {
+			if image.Labels == nil {
+				image.Labels = make(map[string]string)
+			}
+			image.Labels[key] = value
+			changed = append(changed, key+"="+value)
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			image.addEvent(ImageEventLabel, strings.Join(changed, ", "))
+		}
+
+		changed = nil
+		for _, key := range remove {
+			if _, ok := image.Labels[key]; ok {
+				delete(image.Labels, key)
+				changed = append(changed, key)
+			}
+		}
+		if len(changed) > 0 {
+			image.addEvent(ImageEventUnlabel, strings.Join(changed, ", "))
+		}
+		return putImageTx(b, image)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if image.Volume != "" {
+		saveImageProperties(image)
+	}
+	return image, nil
+}
+
+// SetImageLabels sets labels on an image, replacing the values of labels it
+// already has
+func (store *ImageStore) SetImageLabels(r *http.Request, request *LabelsRequest, response *ImageResponse) error {
+	if len(request.Labels) == 0 {
+		return errors.New("need labels")
+	}
+	for key := range request.Labels {
+		if key == "" {
+			return errors.New("label keys can't be empty")
+		}
+	}
+	image, err := store.updateLabels(request.ID, request.Labels, nil)
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: []*Image{image},
+	}
+	return nil
+}
+
+// RemoveImageLabels removes labels from an image
+func (store *ImageStore) RemoveImageLabels(r *http.Request, request *LabelsRequest, response *ImageResponse) error {
+	if len(request.Keys) == 0 {
+		return errors.New("need keys")
+	}
+	image, err := store.updateLabels(request.ID, nil, request.Keys)
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: []*Image{image},
+	}
+	return nil
+}
+
+// SetImageAlias points an alias at an image. An alias of another image is
+// moved, in a single transaction, and the move is recorded in the history of
+// both images.
+func (store *ImageStore) SetImageAlias(r *http.Request, request *AliasRequest, response *ImageResponse) error {
+	if request.Alias == "" {
+		return errors.New("need alias")
+	}
+	id, err := store.resolveImage(request.ID)
+	if err != nil {
+		return err
+	}
+
+	var image *Image
+	err = store.DB.Transaction(func(tx *kvite.Tx) error {
+		images, err := tx.CreateBucketIfNotExists("images")
+		if err != nil {
+			return err
+		}
+		aliases, err := tx.CreateBucketIfNotExists("aliases")
+		if err != nil {
+			return err
+		}
+		image, err = getImageTx(images, id)
+		if err != nil {
+			return err
+		}
+		// An alias that is an image ID would never be resolved
+		if v, err := images.Get(request.Alias); err != nil || v != nil {
+			if err != nil {
+				return err
+			}
+			return errors.New("alias is an image id")
+		}
+
+		v, err := aliases.Get(request.Alias)
+		if err != nil {
+			return err
+		}
+		previous := string(v)
+		if previous == id {
+			return nil
+		}
+		if previous != "" {
+			old, err := getImageTx(images, previous)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			if old != nil {
+				old.removeAlias(request.Alias)
+				old.addEvent(ImageEventUnalias, request.Alias+" moved to "+id)
+				if err := putImageTx(images, old); err != nil {
+					return err
+				}
+			}
+		}
+
+		image.Aliases = append(image.Aliases, request.Alias)
+		sort.Strings(image.Aliases)
+		detail := request.Alias
+		if previous != "" {
+			detail += " moved from " + previous
+		}
+		image.addEvent(ImageEventAlias, detail)
+		if err := putImageTx(images, image); err != nil {
+			return err
+		}
+		return aliases.Put(request.Alias, []byte(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: []*Image{image},
+	}
+	return nil
+}
+
+// RemoveImageAlias removes an alias from the image it points at
+func (store *ImageStore) RemoveImageAlias(r *http.Request, request *AliasRequest, response *ImageResponse) error {
+	if request.Alias == "" {
+		return errors.New("need alias")
+	}
+
+	var image *Image
+	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+		images, err := tx.CreateBucketIfNotExists("images")
+		if err != nil {
+			return err
+		}
+		aliases, err := tx.CreateBucketIfNotExists("aliases")
+		if err != nil {
+			return err
+		}
+		v, err := aliases.Get(request.Alias)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return ErrNotFound
+		}
+		if err := aliases.Delete(request.Alias); err != nil {
+			return err
+		}
+
+		image, err = getImageTx(images, string(v))
+		if err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		image.removeAlias(request.Alias)
+		image.addEvent(ImageEventUnalias, request.Alias)
+		return putImageTx(images, image)
+	})
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{}
+	if image != nil {
+		response.Images = []*Image{image}
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package imagestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+const (
+	// migrationSnapshotPrefix starts the names of the snapshots migration
+	// passes send
+	migrationSnapshotPrefix = "migrate-"
+	// defaultMigrationTimeout is how long sending a guest disk to a peer
+	// agent may take when no timeout is configured
+	defaultMigrationTimeout = 12 * time.Hour
+)
+
+// guestDiskName matches the names CreateGuestDisks gives guest disk volumes
+var guestDiskName = regexp.MustCompile(`^disk-[0-9]+$`)
+
+type (
+	// MigrateRequest is the request for MigrateGuestDisks
+	MigrateRequest struct {
+		Guest *client.Guest `json:"guest"`
+		Dest  string        `json:"dest"`  // HTTP API of the peer agent, host:port or a URL
+		Final bool          `json:"final"` // incremental pass after the guest is paused
+	}
+
+	// DiskMigration is the progress of sending a guest disk to a peer
+	DiskMigration struct {
+		Volume   string `json:"volume"`
+		Snapshot string `json:"snapshot"`
+		From     string `json:"from,omitempty"` // base snapshot of an incremental pass
+		Sent     uint64 `json:"sent"`           // bytes of the stream sent so far
+		Done     bool   `json:"done"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// Migration is the progress of a pass of sending a guest's disks to a peer
+	Migration struct {
+		GuestID string           `json:"guestID"`
+		Dest    string           `json:"dest"`
+		Final   bool             `json:"final"`
+		Done    bool             `json:"done"`            // the pass has finished, successfully or not
+		Error   string           `json:"error,omitempty"` // reason the pass failed
+		Disks   []*DiskMigration `json:"disks"`
+	}
+
+	// MigrationResponse is the response for MigrateGuestDisks and
+	// GetGuestMigration
+	MigrationResponse struct {
+		Migration *Migration `json:"migration"`
+	}
+
+	// migrationTracker keeps the latest migration pass of each guest
+	migrationTracker struct {
+		lock   sync.Mutex
+		guests map[string]*Migration
+		// client and credentials for uploading to peer agents
+		client    *http.Client
+		authorize func(*http.Request)
+	}
+
+	// migrationReader counts the bytes of a disk's stream as they're sent
+	migrationReader struct {
+		reader  io.Reader
+		tracker *migrationTracker
+		disk    *DiskMigration
+	}
+)
+
+func newMigrationTracker(config HTTPConfig) (*migrationTracker, error) {
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = config.MigrationTimeout
+	if client.Timeout == 0 {
+		client.Timeout = defaultMigrationTimeout
+	}
+	authorize, err := config.authorizer()
+	if err != nil {
+		return nil, err
+	}
+	return &migrationTracker{
+		guests:    make(map[string]*Migration),
+		client:    client,
+		authorize: authorize,
+	}, nil
+}
+
+// start tracks a new pass, unless one is already running for the guest
+func (t *migrationTracker) start(migration *Migration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if current, ok := t.guests[migration.GuestID]; ok && !current.Done {
+		return fmt.Errorf("guest %s is already being migrated", migration.GuestID)
+	}
+	t.guests[migration.GuestID] = migration
+	return nil
+}
+
+func (t *migrationTracker) sent(disk *DiskMigration, n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	disk.Sent += uint64(n)
+}
+
+func (t *migrationTracker) finishDisk(disk *DiskMigration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	disk.Done = err == nil
+	if err != nil {
+		disk.Error = err.Error()
+	}
+}
+
+func (t *migrationTracker) finish(migration *Migration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	migration.Done = true
+	if err != nil {
+		migration.Error = err.Error()
+	}
+}
+
+// get returns a copy of the latest pass of a guest, or nil
+func (t *migrationTracker) get(guestID string) *Migration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	current, ok := t.guests[guestID]
+	if !ok {
+		return nil
+	}
+	migration := *current
+	migration.Disks = make([]*DiskMigration, len(current.Disks))
+	for i, disk := range current.Disks {
+		d := *disk
+		migration.Disks[i] = &d
+	}
+	return &migration
+}
+
+func (r *migrationReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.tracker.sent(r.disk, n)
+	return n, err
+}
+
+// guestVolumes returns the disk volumes of a guest created by CreateGuestDisks
+func (store *ImageStore) guestVolumes(guestID string) (*zfs.Dataset, []*zfs.Dataset, error) {
+	guest, err := zfs.GetDataset(filepath.Join(store.config.Zpool, "guests", guestID))
+	if err != nil {
+		if isZfsNotFound(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	children, err := guest.Children(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var volumes []*zfs.Dataset
+	for _, child := range children {
+		if child.Type == "volume" && guestDiskName.MatchString(filepath.Base(child.Name)) {
+			volumes = append(volumes, child)
+		}
+	}
+	if len(volumes) == 0 {
+		return nil, nil, ErrNotFound
+	}
+	return guest, volumes, nil
+}
+
+// latestMigrationSnapshot returns the snapshot of the last migration pass of a
+// volume, if any
+func latestMigrationSnapshot(volume string) (string, error) {
+	snapshots, err := zfs.Snapshots(volume)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	var latestTxg uint64
+	for _, snapshot := range snapshots {
+		parts := strings.SplitN(snapshot.Name, "@", 2)
+		if parts[0] != volume || !strings.HasPrefix(parts[1], migrationSnapshotPrefix) {
+			continue
+		}
+		txg, err := createTxg(snapshot.Name)
+		if err != nil {
+			return "", err
+		}
+		if txg > latestTxg {
+			latest, latestTxg = snapshot.Name, txg
+		}
+	}
+	return latest, nil
+}
+
+// pruneSnapshots destroys the snapshots of a dataset, and the snapshots of the
+// same name of its children, whose names start with prefix, other than keep
+func pruneSnapshots(dataset, prefix, keep string) error {
+	snapshots, err := zfs.Snapshots(dataset)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		parts := strings.SplitN(snapshot.Name, "@", 2)
+		if parts[0] != dataset || parts[1] == keep || !strings.HasPrefix(parts[1], prefix) {
+			continue
+		}
+		if err := zfsCommand(nil, nil, "destroy", "-r", snapshot.Name); err != nil && !isZfsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadURL returns the snapshot upload endpoint of a peer agent
+func uploadURL(dest string) string {
+	if !strings.Contains(dest, "://") {
+		dest = "http://" + dest
+	}
+	return strings.TrimRight(dest, "/") + "/snapshots/upload"
+}
+
+// migrateDisk streams a snapshot of a guest disk, or the changes since the
+// last pass, to the same dataset of a peer agent
+func (store *ImageStore) migrateDisk(dest string, disk *DiskMigration) error {
+	args := []string{"send"}
+	if disk.From != "" {
+		args = append(args, "-i", disk.From)
+	}
+	args = append(args, disk.Snapshot)
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(zfsCommand(nil, writer, args...))
+	}()
+	// Stops the send if the upload fails part way through
+	defer logx.LogReturnedErr(reader.Close, nil, "failed to close migration stream")
+
+	query := url.Values{
+		"id": {strings.TrimPrefix(disk.Volume, store.config.Zpool+"/")},
+		// The final pass replaces anything written to the peer's copy since
+		// the last one
+		"force": {strconv.FormatBool(disk.From != "")},
+	}
+	// Once an incremental pass is received, only its snapshot is needed as
+	// the base of the next one
+	if disk.From != "" {
+		query.Set("prune", migrationSnapshotPrefix)
+	}
+	httpReq, err := http.NewRequest("POST", uploadURL(dest)+"?"+query.Encode(), &migrationReader{
+		reader:  reader,
+		tracker: store.migrations,
+		disk:    disk,
+	})
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	if store.migrations.authorize != nil {
+		store.migrations.authorize(httpReq)
+	}
+	resp, err := store.migrations.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close migration response body")
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// migrateGuest snapshots all of a guest's disks at once, so they're consistent
+// with each other, and sends them one at a time
+func (store *ImageStore) migrateGuest(guest *zfs.Dataset, snapshotName string, migration *Migration) error {
+	if _, err := guest.Snapshot(snapshotName, true); err != nil {
+		return err
+	}
+
+	for _, disk := range migration.Disks {
+		err := store.migrateDisk(migration.Dest, disk)
+		store.migrations.finishDisk(disk, err)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"volume": disk.Volume,
+				"dest":   migration.Dest,
+			}).Error("guest disk migration failed")
+			destroyFailedPass(guest, snapshotName, migration)
+			return err
+		}
+	}
+
+	// The peer has all the disks of an incremental pass, so the earlier
+	// snapshots aren't needed as bases any more
+	if migration.Final {
+		if err := pruneSnapshots(guest.Name, migrationSnapshotPrefix, snapshotName); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"guest": migration.GuestID,
+			}).Warning("failed to prune migration snapshots")
+		}
+	}
+	return nil
+}
+
+// destroyFailedPass destroys the snapshots taken by a failed migration pass.
+// The snapshots of disks the peer did receive are kept, as they are the bases
+// the next pass of those disks is sent from.
+func destroyFailedPass(guest *zfs.Dataset, snapshotName string, migration *Migration) {
+	names := []string{guest.Name + "@" + snapshotName}
+	received := false
+	for _, disk := range migration.Disks {
+		if disk.Done {
+			received = true
+		} else {
+			names = append(names, disk.Snapshot)
+		}
+	}
+	args := []string{"destroy"}
+	if !received {
+		args, names = append(args, "-r"), names[:1]
+	}
+
+	for _, name := range names {
+		if err := zfsCommand(nil, nil, append(args, name)...); err != nil && !isZfsNotFound(err) {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"snapshot": name,
+			}).Warning("failed to destroy snapshot of failed migration pass")
+		}
+	}
+}
+
+/*
+MigrateGuestDisks sends the disks of a guest to a peer agent, where they end up
+with the same layout. The first pass sends a full stream of each disk while the
+guest is still running. After the guest is paused, a final pass sends only the
+changes since. A pass runs in the background once it has started, and its
+progress and outcome can be followed with GetGuestMigration.
+
+	Request params:
+	guest     client.Guest : Req : Guest to migrate, only the id is needed
+	dest      string       : Req : HTTP API of the peer agent, host:port or a URL
+	final     bool         :     : Final incremental pass
+*/
+func (store *ImageStore) MigrateGuestDisks(r *http.Request, request *MigrateRequest, response *MigrationResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" || request.Dest == "" {
+		return EINVAL
+	}
+
+	guest, volumes, err := store.guestVolumes(request.Guest.ID)
+	if err != nil {
+		return err
+	}
+
+	migration := &Migration{
+		GuestID: request.Guest.ID,
+		Dest:    request.Dest,
+		Final:   request.Final,
+		Disks:   make([]*DiskMigration, len(volumes)),
+	}
+	snapshotName := fmt.Sprintf("%s%d", migrationSnapshotPrefix, time.Now().UnixNano())
+	for i, volume := range volumes {
+		disk := &DiskMigration{
+			Volume:   volume.Name,
+			Snapshot: volume.Name + "@" + snapshotName,
+		}
+		if request.Final {
+			if disk.From, err = latestMigrationSnapshot(volume.Name); err != nil {
+				return err
+			}
+			if disk.From == "" {
+				return errors.New("final pass needs an earlier pass of " + volume.Name)
+			}
+		}
+		migration.Disks[i] = disk
+	}
+
+	if err := store.migrations.start(migration); err != nil {
+		return err
+	}
+	go func() {
+		err := store.migrateGuest(guest, snapshotName, migration)
+		store.migrations.finish(migration, err)
+	}()
+
+	*response = MigrationResponse{
+		Migration: store.migrations.get(request.Guest.ID),
+	}
+	return nil
+}
+
+/*
+GetGuestMigration retrieves the progress of the latest migration pass of a
+guest's disks.
+
+	Request params:
+	guest     client.Guest : Req : Guest being migrated, only the id is needed
+*/
+func (store *ImageStore) GetGuestMigration(r *http.Request, request *rpc.GuestRequest, response *MigrationResponse) error {
+	if request.Guest == nil || request.Guest.ID == "" {
+		return EINVAL
+	}
+	migration := store.migrations.get(request.Guest.ID)
+	if migration == nil {
+		return ErrNotFound
+	}
+
+	*response = MigrationResponse{
+		Migration: migration,
+	}
+	return nil
+}
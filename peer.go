@@ -0,0 +1,247 @@
+package imagestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+// sendHasherQueue is how many images can wait to have their send streams
+// hashed. Images turned away are queued again when a peer next asks for them.
+const sendHasherQueue = 64
+
+// sendHasher computes the checksums of the send streams of images in the
+// background, the first time a peer asks for one, so agents that never serve
+// peers never pay for it
+type sendHasher struct {
+	store     *ImageStore
+	queue     chan string
+	timeToDie chan struct{}
+
+	lock sync.Mutex
+	// cancel channels of the images queued or being hashed, by image ID
+	pending map[string]chan struct{}
+}
+
+func newSendHasher(store *ImageStore) *sendHasher {
+	return &sendHasher{
+		store:     store,
+		queue:     make(chan string, sendHasherQueue),
+		timeToDie: make(chan struct{}),
+		pending:   make(map[string]chan struct{}),
+	}
+}
+
+// Run hashes queued images until told to exit
+func (h *sendHasher) Run() {
+	go func() {
+		for {
+			select {
+			case <-h.timeToDie:
+				return
+			case id := <-h.queue:
+				h.hash(id)
+			}
+		}
+	}()
+}
+
+// Exit stops hashing, interrupting the image being hashed
+func (h *sendHasher) Exit() {
+	h.lock.Lock()
+	for id, cancel := range h.pending {
+		close(cancel)
+		delete(h.pending, id)
+	}
+	h.lock.Unlock()
+	close(h.timeToDie)
+}
+
+// request queues an image to be hashed, unless it already is
+func (h *sendHasher) request(id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.pending[id]; ok {
+		return
+	}
+	select {
+	case h.queue <- id:
+		h.pending[id] = make(chan struct{})
+	default:
+	}
+}
+
+// cancel stops hashing an image, such as one about to be destroyed
+func (h *sendHasher) cancel(id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if cancel, ok := h.pending[id]; ok {
+		close(cancel)
+		delete(h.pending, id)
+	}
+}
+
+// done forgets an image that has been hashed, unless it has been canceled and
+// queued again since
+func (h *sendHasher) done(id string, cancel chan struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.pending[id] == cancel {
+		delete(h.pending, id)
+	}
+}
+
+// hash computes and records the checksum of the send stream of an image
+func (h *sendHasher) hash(id string) {
+	h.lock.Lock()
+	cancel, ok := h.pending[id]
+	h.lock.Unlock()
+	if !ok {
+		// Canceled while queued
+		return
+	}
+	defer h.done(id, cancel)
+
+	image, err := h.store.getReadyImage(id)
+	if err != nil || image.SendChecksum != "" {
+		return
+	}
+	snapshot, err := zfs.GetDataset(image.Snapshot)
+	if err == nil {
+		var checksum string
+		checksum, err = sendChecksum(snapshot, cancel)
+		if err == nil {
+			// The image may have been fetched again while it was hashed
+			err = h.store.updateExistingImage(id, func(image *Image) {
+				if image.Snapshot == snapshot.Name {
+					image.SendChecksum = checksum
+				}
+			})
+		}
+	}
+	if err != nil && err != ErrCanceled {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": id,
+		}).Warning("could not compute the checksum of the image send stream")
+	}
+}
+
+// sendChecksum computes the digest of the send stream of a snapshot, which is
+// what peers are served. Closing cancel stops the send.
+func sendChecksum(snapshot *zfs.Dataset, cancel chan struct{}) (string, error) {
+	hash := sha256.New()
+	if err := snapshot.SendSnapshot(&cancelWriter{writer: hash, cancel: cancel}); err != nil {
+		if isCanceled(cancel) {
+			return "", ErrCanceled
+		}
+		return "", err
+	}
+	return checksumPrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// peerLocations returns where peer agents may serve an image from, if any
+// are configured. Peers serve the send streams of their copies of images, so
+// downloads from them are verified against the checksums they recorded for
+// the streams. The streams aren't signed, so they can't be used when images
+// have to be verified against the trust store.
+func (store *ImageStore) peerLocations(id string) []fetchLocation {
+	if len(store.peers.servers) == 0 || store.trustStore != nil {
+		return nil
+	}
+	locations, err := store.peers.locations(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"id":    id,
+		}).Warning("no peers available to fetch image from")
+		return nil
+	}
+	for i := range locations {
+		locations[i].peer = true
+	}
+	return locations
+}
+
+// peerImageID gets the image ID out of the path of a peer endpoint, of the
+// form /images/{id}/...
+func peerImageID(r *http.Request) string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/images/"), "/")
+	return parts[0]
+}
+
+// servedImage looks up an image a peer asked for and the checksum of its send
+// stream. An image without one isn't served, as the peer would have nothing
+// to verify it with, but its send stream is hashed in the background so it
+// can be served next time.
+func (store *ImageStore) servedImage(id string) (*zfs.Dataset, string, error) {
+	image, err := store.getReadyImage(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if image.SendChecksum == "" {
+		store.sendHasher.request(image.ID)
+		return nil, "", ErrNotFound
+	}
+	snapshot, err := zfs.GetDataset(image.Snapshot)
+	if err != nil {
+		if isZfsNotFound(err) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", err
+	}
+	return snapshot, image.SendChecksum, nil
+}
+
+// servePeerError responds to a peer with the status for an error. Images that
+// aren't ready are as good as not found, so the peer moves on.
+func servePeerError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound, ErrNotReady:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ServeImage serves an image to peer agents, like an image server, as the zfs
+// send stream of its snapshot. The checksum of the stream is sent in the
+// X-Image-Checksum header for the peer to verify the download with.
+func (store *ImageStore) ServeImage(w http.ResponseWriter, r *http.Request) {
+	snapshot, checksum, err := store.servedImage(peerImageID(r))
+	if err != nil {
+		servePeerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(checksumHeader, checksum)
+	if err := snapshot.SendSnapshot(w); err != nil {
+		// The headers are already sent, so the peer will find the stream
+		// doesn't match the checksum
+		log.WithFields(log.Fields{
+			"error":    err,
+			"snapshot": snapshot.Name,
+		}).Error("failed to serve image to peer")
+	}
+}
+
+// ServeImageChecksum serves the checksum of the send stream of an image to
+// peer agents, like the checksum file of an image server
+func (store *ImageStore) ServeImageChecksum(w http.ResponseWriter, r *http.Request) {
+	_, checksum, err := store.servedImage(peerImageID(r))
+	if err != nil {
+		servePeerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(checksum + "\n")); err != nil {
+		log.WithField("error", err).Error("failed to serve image checksum to peer")
+	}
+}
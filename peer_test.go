@@ -0,0 +1,189 @@
+package imagestore_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type PeerTestSuite struct {
+	APITestSuite
+	// A second store, with its own zpool, that the suite's store has as a
+	// peer
+	PeerPort     int
+	PeerID       string
+	PeerZpool    *zfs.Zpool
+	PeerZpoolDir string
+	PeerConfig   imagestore.Config
+	PeerStore    *imagestore.ImageStore
+	PeerServer   *graceful.Server
+	PeerClient   *rpc.Client
+}
+
+func TestPeerTestSuite(t *testing.T) {
+	s := new(PeerTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *PeerTestSuite) configure(config *imagestore.Config) {
+	// The peer fetches from the same image service, but has no peers itself
+	s.PeerConfig = *config
+	s.PeerPort = 54322
+	s.PeerClient, _ = rpc.NewClient(uint(s.PeerPort), "")
+	config.Peers = []string{fmt.Sprintf("localhost:%d", s.PeerPort)}
+}
+
+func (s *PeerTestSuite) SetupTest() {
+	s.APITestSuite.SetupTest()
+	require := s.Require()
+
+	s.PeerID = "mist-" + uuid.New()
+	s.PeerConfig.Zpool = s.PeerID
+	s.PeerZpool, s.PeerZpoolDir = s.createZpool(s.PeerID)
+
+	var err error
+	s.PeerStore, err = imagestore.Create(s.PeerConfig)
+	require.NoError(err)
+	go s.PeerStore.Run()
+	s.PeerServer = s.PeerStore.RunHTTP(uint(s.PeerPort))
+}
+
+func (s *PeerTestSuite) TearDownTest() {
+	stopChan := s.PeerServer.StopChan()
+	s.PeerServer.Stop(5 * time.Second)
+	<-stopChan
+	logx.LogReturnedErr(s.PeerStore.Destroy, nil, "failed to stop/destroy peer store")
+	logx.LogReturnedErr(s.PeerZpool.Destroy, nil, "unable to destroy zpool "+s.PeerID)
+	logx.LogReturnedErr(func() error { return os.RemoveAll(s.PeerZpoolDir) },
+		nil, "unable to remove dir "+s.PeerZpoolDir)
+
+	s.APITestSuite.TearDownTest()
+}
+
+// fetchPeerImage has the peer fetch an image from the image service
+func (s *PeerTestSuite) fetchPeerImage(id string) *imagestore.Image {
+	response := &imagestore.ImageResponse{}
+	request := &imagestore.ImageRequest{ImageRequest: rpc.ImageRequest{ID: id}}
+	s.Require().NoError(s.PeerClient.Do("ImageStore.RequestImage", request, response))
+	s.Require().Len(response.Images, 1)
+	return response.Images[0]
+}
+
+// waitForSendChecksum asks a store for the checksum of the send stream of an
+// image until it has been computed, returning it
+func (s *PeerTestSuite) waitForSendChecksum(port int, id string) string {
+	url := fmt.Sprintf("http://localhost:%d/images/%s/checksum", port, id)
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		s.Require().NoError(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		s.Require().NoError(err)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		if resp.StatusCode == http.StatusOK {
+			return strings.TrimSpace(string(data))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Fail("send stream checksum was never computed")
+	return ""
+}
+
+func (s *PeerTestSuite) TestServeImage() {
+	s.fetchImage()
+
+	response := &imagestore.ImageResponse{}
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	s.Require().NoError(s.Client.Do("ImageStore.GetImage", request, response))
+	s.Require().Len(response.Images, 1)
+	s.Empty(response.Images[0].SendChecksum, "should not hash the send stream until a peer asks for it")
+
+	// The first request has the send stream hashed in the background
+	checksum := s.waitForSendChecksum(s.Port, s.ImageID)
+	response = &imagestore.ImageResponse{}
+	s.Require().NoError(s.Client.Do("ImageStore.GetImage", request, response))
+	s.Require().Len(response.Images, 1)
+	s.Equal(checksum, response.Images[0].SendChecksum, "should record the send stream checksum")
+
+	tests := []struct {
+		description        string
+		id                 string
+		expectedStatusCode int
+	}{
+		{"missing image", "asdf", http.StatusNotFound},
+		{"image", s.ImageID, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/images/%s/download", s.Port, test.id))
+		if !s.NoError(err, msg("should not error")) {
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		s.NoError(err, msg("should read the download"))
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		s.Equal(test.expectedStatusCode, resp.StatusCode, msg("should return expected http status code"))
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		s.Equal(fmt.Sprintf("sha256:%x", sha256.Sum256(data)), checksum, msg("should serve the stream the checksum is of"))
+		s.Equal(checksum, resp.Header.Get("X-Image-Checksum"), msg("should send the checksum of the stream"))
+	}
+}
+
+func (s *PeerTestSuite) TestRequestImagePeer() {
+	imageURL, _ := url.Parse(s.ImageService.URL)
+	peerHost := fmt.Sprintf("localhost:%d", s.PeerPort)
+
+	// The peer has both images, but has only been asked for one, so it can't
+	// serve the other yet
+	s.Equal(imagestore.ImageStatusComplete, s.fetchPeerImage(s.ImageID).Status)
+	s.Equal(imagestore.ImageStatusComplete, s.fetchPeerImage("gzipID").Status)
+	sent := s.waitForSendChecksum(s.PeerPort, s.ImageID)
+
+	tests := []struct {
+		description          string
+		id                   string
+		expectedMirror       string
+		expectedSendChecksum string
+	}{
+		{"image the peer serves", s.ImageID, peerHost, sent},
+		{"image the peer can't serve yet", "gzipID", imageURL.Host, ""},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := &imagestore.ImageResponse{}
+		request := &imagestore.ImageRequest{ImageRequest: rpc.ImageRequest{ID: test.id}}
+		s.NoError(s.Client.Do("ImageStore.RequestImage", request, response), msg("should not error"))
+		if !s.Len(response.Images, 1, msg("should return the image")) {
+			continue
+		}
+		image := response.Images[0]
+		s.Equal(imagestore.ImageStatusComplete, image.Status, msg("should be complete"))
+		s.Equal(test.expectedMirror, image.Mirror, msg("should be fetched from the expected mirror"))
+		s.Equal(test.expectedSendChecksum, image.SendChecksum, msg("should record the checksum of a fetched send stream"))
+	}
+
+	// A copy from a peer keeps the checksum of the image from its origin
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", &rpc.ImageRequest{ID: s.ImageID}, response))
+	if s.Len(response.Images, 1) {
+		s.Equal(fmt.Sprintf("sha256:%x", sha256.Sum256(s.ImageData)), response.Images[0].Checksum, "should keep the origin checksum")
+	}
+}
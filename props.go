@@ -0,0 +1,368 @@
+package imagestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/kvite"
+)
+
+// ZFS user properties image metadata is kept in on image volumes, and
+// inherited by their snapshots, so the images bucket can be rebuilt from the
+// datasets if it is lost
+const (
+	imageIDProperty      = "mistify:image-id"
+	checksumProperty     = "mistify:checksum"
+	sourceProperty       = "mistify:source"
+	mirrorProperty       = "mistify:mirror"
+	fetchedProperty      = "mistify:fetched"
+	lastUsedProperty     = "mistify:last-used"
+	pinnedProperty       = "mistify:pinned"
+	labelsProperty       = "mistify:labels"
+	statusProperty       = "mistify:status"
+	verifiedProperty     = "mistify:verified"
+	signingKeyProperty   = "mistify:signing-key"
+	compressionProperty  = "mistify:compression"
+	formatProperty       = "mistify:format"
+	sendChecksumProperty = "mistify:send-checksum"
+)
+
+// imageProperties are the user properties listed for image volumes, in the
+// order of their columns
+var imageProperties = []string{
+	imageIDProperty,
+	checksumProperty,
+	sourceProperty,
+	mirrorProperty,
+	fetchedProperty,
+	lastUsedProperty,
+	pinnedProperty,
+	labelsProperty,
+	statusProperty,
+	verifiedProperty,
+	signingKeyProperty,
+	compressionProperty,
+	formatProperty,
+	sendChecksumProperty,
+}
+
+// RebuildRequest is the request for RebuildImages
+type RebuildRequest struct{}
+
+// imagePropertyValues returns the user properties of an image volume for the
+// metadata of an image
+func imagePropertyValues(image *Image) map[string]string {
+	labels, _ := json.Marshal(image.Labels)
+	return map[string]string{
+		imageIDProperty:      image.ID,
+		checksumProperty:     image.Checksum,
+		sourceProperty:       image.Source,
+		mirrorProperty:       image.Mirror,
+		fetchedProperty:      image.Fetched.UTC().Format(time.RFC3339),
+		lastUsedProperty:     image.LastUsed.UTC().Format(time.RFC3339),
+		pinnedProperty:       strconv.FormatBool(image.Pinned),
+		labelsProperty:       string(labels),
+		statusProperty:       image.Status,
+		verifiedProperty:     strconv.FormatBool(image.Verified),
+		signingKeyProperty:   image.SigningKey,
+		compressionProperty:  image.Compression,
+		formatProperty:       image.Format,
+		sendChecksumProperty: image.SendChecksum,
+	}
+}
+
+// setImageProperties saves the metadata of an image as user properties of its
+// volume. Cleared fields are set to empty values, rather than inherited, so
+// all of the properties are set with one command.
+func setImageProperties(image *Image) error {
+	values := imagePropertyValues(image)
+	args := []string{"set"}
+	for _, property := range imageProperties {
+		args = append(args, property+"="+values[property])
+	}
+	return zfsCommand(nil, nil, append(args, image.Volume)...)
+}
+
+// propertiesChanged determines whether the user properties of an image volume
+// need to be saved again. The last used time changes whenever an image is
+// cloned, so it is left to the collector to save.
+func propertiesChanged(before, after map[string]string) bool {
+	for property, value := range after {
+		if property != lastUsedProperty && before[property] != value {
+			return true
+		}
+	}
+	return false
+}
+
+// saveImageProperties sets the user properties of an image volume, logging
+// any failure. Images whose volume is gone are skipped.
+func saveImageProperties(image *Image) {
+	if err := setImageProperties(image); err != nil && !isZfsNotFound(err) {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"dataset": image.Volume,
+		}).Warning("could not set image properties")
+	}
+}
+
+// imageLocks serializes writing the metadata of each image to its record and
+// its volume, so a volume can't be left with the older of two updates
+type imageLocks struct {
+	lock  sync.Mutex
+	locks map[string]*imageLock
+}
+
+// imageLock is the lock of one image and how many are holding or waiting for
+// it
+type imageLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newImageLocks() *imageLocks {
+	return &imageLocks{
+		locks: make(map[string]*imageLock),
+	}
+}
+
+// acquire locks an image, returning a function to unlock it
+func (l *imageLocks) acquire(id string) func() {
+	l.lock.Lock()
+	il, ok := l.locks[id]
+	if !ok {
+		il = &imageLock{}
+		l.locks[id] = il
+	}
+	il.refs++
+	l.lock.Unlock()
+
+	il.Lock()
+	return func() {
+		il.Unlock()
+		l.lock.Lock()
+		il.refs--
+		if il.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.lock.Unlock()
+	}
+}
+
+// flushLastUsed saves the last used times of images that have been used since
+// the last flush to their volumes
+func (store *ImageStore) flushLastUsed(ids []string) {
+	for _, id := range ids {
+		unlock := store.imageLocks.acquire(id)
+		image, err := store.getImage(id)
+		if err == nil && image.Volume != "" {
+			value := image.LastUsed.UTC().Format(time.RFC3339)
+			err = zfsCommand(nil, nil, "set", lastUsedProperty+"="+value, image.Volume)
+		}
+		unlock()
+		if err != nil && err != ErrNotFound && !isZfsNotFound(err) {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": id,
+			}).Warning("could not save image last used time")
+		}
+	}
+}
+
+// datasetImages builds image records from the user properties of the image
+// volumes in the image store. Volumes without an image ID or a snapshot are
+// skipped.
+func (store *ImageStore) datasetImages() ([]*Image, error) {
+	var out bytes.Buffer
+	columns := "name," + strings.Join(imageProperties, ",")
+	if err := zfsCommand(nil, &out, "list", "-H", "-d", "1", "-t", "volume", "-o", columns, store.dataset); err != nil {
+		return nil, err
+	}
+
+	var images []*Image
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(imageProperties)+1 {
+			continue
+		}
+		values := make(map[string]string, len(imageProperties))
+		for i, property := range imageProperties {
+			// Unset properties are listed as -
+			if value := fields[i+1]; value != "-" {
+				values[property] = value
+			}
+		}
+		if values[imageIDProperty] == "" {
+			continue
+		}
+
+		snapshot, err := latestSnapshot(fields[0])
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		image := &Image{
+			Checksum:     values[checksumProperty],
+			Source:       values[sourceProperty],
+			Mirror:       values[mirrorProperty],
+			Verified:     values[verifiedProperty] == "true",
+			Pinned:       values[pinnedProperty] == "true",
+			SigningKey:   values[signingKeyProperty],
+			Compression:  values[compressionProperty],
+			Format:       values[formatProperty],
+			SendChecksum: values[sendChecksumProperty],
+		}
+		image.ID = values[imageIDProperty]
+		image.Volume = fields[0]
+		image.Snapshot = snapshot.Name
+		image.Size = snapshot.Volsize / 1024 / 1024
+		image.Status = values[statusProperty]
+		if image.Status == "" {
+			image.Status = ImageStatusComplete
+		}
+		if fetched, err := time.Parse(time.RFC3339, values[fetchedProperty]); err == nil {
+			image.Fetched = fetched
+			image.LastUsed = fetched
+		}
+		if lastUsed, err := time.Parse(time.RFC3339, values[lastUsedProperty]); err == nil {
+			image.LastUsed = lastUsed
+		}
+		if labels := values[labelsProperty]; labels != "" {
+			if err := json.Unmarshal([]byte(labels), &image.Labels); err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"dataset": fields[0],
+				}).Warning("could not parse image labels property")
+			}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// backfillProperties sets the user properties of image volumes that don't have
+// them from their records, such as volumes of images fetched before the
+// properties were kept, so rebuilding doesn't lose their records
+func (store *ImageStore) backfillProperties() error {
+	images, err := store.listImages()
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.Status != ImageStatusComplete || image.Volume == "" {
+			continue
+		}
+		values, err := zfsProperties(image.Volume, imageIDProperty)
+		if err != nil {
+			if isZfsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		// Unset properties are listed as -
+		if id := values[imageIDProperty]; id != "" && id != "-" {
+			continue
+		}
+		if err := setImageProperties(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuild replaces the image records with ones built from the user properties
+// of the image volumes. Records of images being fetched are kept, and volumes
+// without properties get them from their records first.
+func (store *ImageStore) rebuild() ([]*Image, error) {
+	if err := store.backfillProperties(); err != nil {
+		return nil, err
+	}
+	images, err := store.datasetImages()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.CreateBucketIfNotExists("images")
+		if err != nil {
+			return err
+		}
+		var stale []string
+		if err := b.ForEach(func(k string, v []byte) error {
+			if !store.fetcher.fetching(k) {
+				stale = append(stale, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range stale {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+
+		// Aliases are kept in their own bucket, so they survive a rebuild
+		// if the database wasn't lost
+		aliases, err := tx.CreateBucketIfNotExists("aliases")
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]*Image, len(images))
+		for _, image := range images {
+			byID[image.ID] = image
+		}
+		if err := aliases.ForEach(func(k string, v []byte) error {
+			if image := byID[string(v)]; image != nil {
+				image.Aliases = append(image.Aliases, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, image := range images {
+			sort.Strings(image.Aliases)
+			if store.fetcher.fetching(image.ID) {
+				continue
+			}
+			v, err := json.Marshal(image)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(image.ID, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("images", len(images)).Info("rebuilt image records from datasets")
+	return images, nil
+}
+
+// RebuildImages rebuilds the image records from the metadata kept on the
+// image datasets, discarding anything only the records knew
+func (store *ImageStore) RebuildImages(r *http.Request, request *RebuildRequest, response *ImageResponse) error {
+	images, err := store.rebuild()
+	if err != nil {
+		return err
+	}
+
+	*response = ImageResponse{
+		Images: images,
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package imagestore
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	qcow2Magic = "QFI\xfb"
+	// size of the version 2 header, which version 3 extends
+	qcow2HeaderSize = 72
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2CompressedFlag = 1 << 62
+	qcow2ZeroFlag       = 1 << 0
+
+	// incompatible features that can be ignored when only reading
+	qcow2DirtyFeature = 1 << 0
+
+	// largest l1 table qemu accepts, in bytes
+	qcow2MaxL1Size = 32 * 1024 * 1024
+)
+
+type (
+	// qcow2Image reads the guest disk contents of a qcow2 image. Images with
+	// a backing file, encryption, or any other incompatible feature aren't
+	// supported.
+	qcow2Image struct {
+		file        io.ReaderAt
+		clusterBits uint32
+		size        uint64
+		l1Size      uint32
+		l1Offset    uint64
+	}
+
+	// qcow2Header is the version 2 header, also the start of version 3
+	qcow2Header struct {
+		Magic                 [4]byte
+		Version               uint32
+		BackingFileOffset     uint64
+		BackingFileSize       uint32
+		ClusterBits           uint32
+		Size                  uint64
+		CryptMethod           uint32
+		L1Size                uint32
+		L1TableOffset         uint64
+		RefcountTableOffset   uint64
+		RefcountTableClusters uint32
+		NbSnapshots           uint32
+		SnapshotsOffset       uint64
+	}
+)
+
+// openQcow2 reads the header of a qcow2 image file of the given size
+func openQcow2(file io.ReaderAt, fileSize int64) (*qcow2Image, error) {
+	var header qcow2Header
+	if err := binary.Read(io.NewSectionReader(file, 0, qcow2HeaderSize), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != qcow2Magic {
+		return nil, errors.New("not a qcow2 image")
+	}
+
+	switch header.Version {
+	case 2:
+	case 3:
+		var features uint64
+		if err := binary.Read(io.NewSectionReader(file, qcow2HeaderSize, 8), binary.BigEndian, &features); err != nil {
+			return nil, err
+		}
+		if features&^qcow2DirtyFeature != 0 {
+			return nil, fmt.Errorf("unsupported qcow2 features %#x", features)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", header.Version)
+	}
+
+	if header.BackingFileOffset != 0 {
+		return nil, errors.New("qcow2 images with a backing file are not supported")
+	}
+	if header.CryptMethod != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	if header.ClusterBits < 9 || header.ClusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d", header.ClusterBits)
+	}
+
+	q := &qcow2Image{
+		file:        file,
+		clusterBits: header.ClusterBits,
+		size:        header.Size,
+		l1Size:      header.L1Size,
+		l1Offset:    header.L1TableOffset,
+	}
+	// The l1 table is allocated from its size, so it has to fit in the file
+	// and be no larger than qemu allows. It may be larger than the image
+	// size needs, such as after the image is shrunk.
+	perL1Entry := q.l2Entries() * q.clusterSize()
+	needed := q.size / perL1Entry
+	if q.size%perL1Entry != 0 {
+		needed++
+	}
+	if uint64(q.l1Size) < needed {
+		return nil, errors.New("qcow2 l1 table too small for the image size")
+	}
+	if fileSize < 0 || q.l1Offset > uint64(fileSize) || uint64(q.l1Size)*8 > uint64(fileSize)-q.l1Offset {
+		return nil, errors.New("qcow2 l1 table extends past the end of the file")
+	}
+	if uint64(q.l1Size)*8 > qcow2MaxL1Size {
+		return nil, errors.New("qcow2 l1 table too large")
+	}
+	return q, nil
+}
+
+func (q *qcow2Image) clusterSize() uint64 {
+	return 1 << q.clusterBits
+}
+
+// l2Entries is the number of entries in an L2 table, which is one cluster
+func (q *qcow2Image) l2Entries() uint64 {
+	return q.clusterSize() / 8
+}
+
+// readTable reads a table of big endian uint64 entries
+func (q *qcow2Image) readTable(offset uint64, entries uint64) ([]uint64, error) {
+	table := make([]uint64, entries)
+	reader := io.NewSectionReader(q.file, int64(offset), int64(entries*8))
+	if err := binary.Read(reader, binary.BigEndian, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// readCluster reads the guest data of an L2 entry into cluster. It returns
+// false if the cluster reads as zeros.
+func (q *qcow2Image) readCluster(entry uint64, cluster []byte) (bool, error) {
+	if entry&qcow2CompressedFlag != 0 {
+		return true, q.readCompressedCluster(entry, cluster)
+	}
+
+	offset := entry & qcow2OffsetMask
+	if offset == 0 || entry&qcow2ZeroFlag != 0 {
+		return false, nil
+	}
+	n, err := q.file.ReadAt(cluster, int64(offset))
+	if err == io.EOF && n == len(cluster) {
+		err = nil
+	}
+	return true, err
+}
+
+// readCompressedCluster reads a deflate compressed cluster
+func (q *qcow2Image) readCompressedCluster(entry uint64, cluster []byte) error {
+	offsetBits := 62 - (q.clusterBits - 8)
+	offset := entry & (1<<offsetBits - 1)
+	sectors := (entry >> offsetBits) & (1<<(q.clusterBits-8) - 1)
+	size := (sectors+1)*512 - offset%512
+
+	compressed := make([]byte, size)
+	n, err := q.file.ReadAt(compressed, int64(offset))
+	// The compressed data may be shorter than the sectors it claims, at the
+	// end of the file
+	if err != nil && !(err == io.EOF && n > 0) {
+		return err
+	}
+
+	reader := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer func() { _ = reader.Close() }()
+	_, err = io.ReadFull(reader, cluster)
+	return err
+}
+
+// writeTo writes the guest disk contents to w, skipping clusters that read as
+// zeros
+func (q *qcow2Image) writeTo(w io.WriterAt, cancel chan struct{}) error {
+	l1, err := q.readTable(q.l1Offset, uint64(q.l1Size))
+	if err != nil {
+		return err
+	}
+
+	cluster := make([]byte, q.clusterSize())
+	for i, l1Entry := range l1 {
+		l2Offset := l1Entry & qcow2OffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		l2, err := q.readTable(l2Offset, q.l2Entries())
+		if err != nil {
+			return err
+		}
+
+		for j, l2Entry := range l2 {
+			guestOffset := (uint64(i)*q.l2Entries() + uint64(j)) * q.clusterSize()
+			if guestOffset >= q.size {
+				return nil
+			}
+			if isCanceled(cancel) {
+				return ErrCanceled
+			}
+
+			allocated, err := q.readCluster(l2Entry, cluster)
+			if err != nil {
+				return err
+			}
+			if !allocated {
+				continue
+			}
+
+			data := cluster
+			if remaining := q.size - guestOffset; remaining < uint64(len(data)) {
+				data = data[:remaining]
+			}
+			if isZero(data) {
+				continue
+			}
+			if _, err := w.WriteAt(data, int64(guestOffset)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// qcow2Layout is the layout of a version 2 qcow2 image of a disk, with 64K
+// clusters and every cluster of zeros left unallocated. Clusters are laid out
+// as the header, the L1 table, the refcount table, the refcount blocks, the L2
+// tables and then the data in guest order.
+type qcow2Layout struct {
+	disk      io.ReaderAt
+	size      uint64
+	allocated []bool // guest clusters that hold data
+
+	l1Size       uint64
+	l2Tables     []bool // L1 entries that have an L2 table
+	l1Clusters   uint64
+	rtClusters   uint64
+	rbClusters   uint64
+	l2Clusters   uint64
+	dataClusters uint64
+}
+
+// qcow2ExportClusterBits is the cluster size of exported qcow2 images
+const qcow2ExportClusterBits = 16
+
+// newQcow2Layout reads a disk to find which clusters hold data and lays out a
+// qcow2 image of it
+func newQcow2Layout(disk io.ReaderAt, size uint64, cancel chan struct{}) (*qcow2Layout, error) {
+	const clusterSize = 1 << qcow2ExportClusterBits
+	const l2Entries = clusterSize / 8
+
+	clusters := (size + clusterSize - 1) / clusterSize
+	l := &qcow2Layout{
+		disk:      disk,
+		size:      size,
+		allocated: make([]bool, clusters),
+		l1Size:    (clusters + l2Entries - 1) / l2Entries,
+	}
+	if l.l1Size == 0 {
+		l.l1Size = 1
+	}
+	l.l2Tables = make([]bool, l.l1Size)
+
+	cluster := make([]byte, clusterSize)
+	for i := range l.allocated {
+		if isCanceled(cancel) {
+			return nil, ErrCanceled
+		}
+		data, err := l.readCluster(uint64(i), cluster)
+		if err != nil {
+			return nil, err
+		}
+		if isZero(data) {
+			continue
+		}
+		l.allocated[i] = true
+		l.dataClusters++
+		if !l.l2Tables[i/l2Entries] {
+			l.l2Tables[i/l2Entries] = true
+			l.l2Clusters++
+		}
+	}
+
+	l.l1Clusters = (l.l1Size*8 + clusterSize - 1) / clusterSize
+
+	// The refcount blocks cover every cluster, including themselves and the
+	// refcount table, so grow them until they are big enough
+	fixed := 1 + l.l1Clusters + l.l2Clusters + l.dataClusters
+	l.rtClusters, l.rbClusters = 1, 1
+	for {
+		total := fixed + l.rtClusters + l.rbClusters
+		rb := (total + clusterSize/2 - 1) / (clusterSize / 2)
+		rt := (rb*8 + clusterSize - 1) / clusterSize
+		if rb == l.rbClusters && rt == l.rtClusters {
+			break
+		}
+		l.rbClusters, l.rtClusters = rb, rt
+	}
+	return l, nil
+}
+
+// readCluster reads a guest cluster, which is short at the end of the disk
+func (l *qcow2Layout) readCluster(index uint64, cluster []byte) ([]byte, error) {
+	offset := index << qcow2ExportClusterBits
+	data := cluster
+	if remaining := l.size - offset; remaining < uint64(len(data)) {
+		data = data[:remaining]
+	}
+	n, err := l.disk.ReadAt(data, int64(offset))
+	if err == io.EOF && n == len(data) {
+		err = nil
+	}
+	return data, err
+}
+
+func (l *qcow2Layout) totalClusters() uint64 {
+	return 1 + l.l1Clusters + l.rtClusters + l.rbClusters + l.l2Clusters + l.dataClusters
+}
+
+// length is the size of the qcow2 image in bytes
+func (l *qcow2Layout) length() int64 {
+	return int64(l.totalClusters() << qcow2ExportClusterBits)
+}
+
+// writeTo writes the qcow2 image, reading the data clusters from the disk
+// again
+func (l *qcow2Layout) writeTo(w io.Writer, cancel chan struct{}) error {
+	const clusterSize = 1 << qcow2ExportClusterBits
+	const l2Entries = clusterSize / 8
+	const copied = 1 << 63
+
+	rtStart := 1 + l.l1Clusters
+	rbStart := rtStart + l.rtClusters
+	l2Start := rbStart + l.rbClusters
+	dataStart := l2Start + l.l2Clusters
+
+	header := qcow2Header{
+		Version:               2,
+		ClusterBits:           qcow2ExportClusterBits,
+		Size:                  l.size,
+		L1Size:                uint32(l.l1Size),
+		L1TableOffset:         clusterSize,
+		RefcountTableOffset:   rtStart * clusterSize,
+		RefcountTableClusters: uint32(l.rtClusters),
+	}
+	copy(header.Magic[:], qcow2Magic)
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	buf.Write(make([]byte, clusterSize-buf.Len()))
+
+	// L1 table
+	l1 := make([]byte, l.l1Clusters*clusterSize)
+	l2Offset := l2Start * clusterSize
+	for i, ok := range l.l2Tables {
+		if ok {
+			binary.BigEndian.PutUint64(l1[i*8:], l2Offset|copied)
+			l2Offset += clusterSize
+		}
+	}
+	buf.Write(l1)
+
+	// Refcount table and blocks, with a refcount of 1 for every cluster
+	rt := make([]byte, l.rtClusters*clusterSize)
+	for i := uint64(0); i < l.rbClusters; i++ {
+		binary.BigEndian.PutUint64(rt[i*8:], (rbStart+i)*clusterSize)
+	}
+	buf.Write(rt)
+	rb := make([]byte, l.rbClusters*clusterSize)
+	for i := uint64(0); i < l.totalClusters(); i++ {
+		binary.BigEndian.PutUint16(rb[i*2:], 1)
+	}
+	buf.Write(rb)
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+
+	// L2 tables, pointing at the data clusters in guest order
+	dataOffset := dataStart * clusterSize
+	l2 := make([]byte, clusterSize)
+	for i, ok := range l.l2Tables {
+		if !ok {
+			continue
+		}
+		for j := range l2 {
+			l2[j] = 0
+		}
+		for j := 0; j < l2Entries; j++ {
+			index := i*l2Entries + j
+			if index < len(l.allocated) && l.allocated[index] {
+				binary.BigEndian.PutUint64(l2[j*8:], dataOffset|copied)
+				dataOffset += clusterSize
+			}
+		}
+		if _, err := w.Write(l2); err != nil {
+			return err
+		}
+	}
+
+	// Data clusters, padded to a whole cluster at the end of the disk
+	cluster := make([]byte, clusterSize)
+	for i, ok := range l.allocated {
+		if !ok {
+			continue
+		}
+		if isCanceled(cancel) {
+			return ErrCanceled
+		}
+		for j := range cluster {
+			cluster[j] = 0
+		}
+		if _, err := l.readCluster(uint64(i), cluster); err != nil {
+			return err
+		}
+		if _, err := w.Write(cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
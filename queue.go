@@ -0,0 +1,185 @@
+package imagestore
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type (
+	// fetchQueue is the admission control of new fetches. Fetches are queued
+	// from when they are admitted until they get a concurrency slot, and at
+	// most maxPending can be queued at once. Requests for images already
+	// being fetched share those fetches and are always admitted.
+	fetchQueue struct {
+		maxPending uint          // 0 for unlimited
+		wait       time.Duration // how long to wait for room before EAGAIN
+		// fetches admitted but not processed yet
+		reserved uint
+		// fetches processed and waiting for a concurrency slot, by image
+		queued map[string]bool
+		// fetches holding a concurrency slot
+		inFlight uint
+		// closed and replaced whenever room is made in the queue
+		changed chan struct{}
+	}
+
+	// FetchQueueRequest is the request for GetFetchQueue
+	FetchQueueRequest struct{}
+
+	// FetchQueue is the state of the fetch queue
+	FetchQueue struct {
+		Depth       uint     `json:"depth"`      // fetches waiting to start
+		MaxPending  uint     `json:"maxPending"` // 0 for unlimited
+		InFlight    uint     `json:"inFlight"`   // fetches in progress
+		Concurrency uint     `json:"concurrency"`
+		Queued      []string `json:"queued"` // images waiting to start
+	}
+
+	// FetchQueueResponse is the response for GetFetchQueue
+	FetchQueueResponse struct {
+		Queue *FetchQueue `json:"queue"`
+	}
+)
+
+// depth is how many fetches are waiting to start. The fetcher lock must be
+// held.
+func (q *fetchQueue) depth() uint {
+	return q.reserved + uint(len(q.queued))
+}
+
+// notify wakes up requests waiting for room in the queue. The fetcher lock
+// must be held.
+func (q *fetchQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// admit reserves room in the queue for a new fetch, waiting up to the
+// configured time for room if the queue is full. It fails with EAGAIN if
+// there's no room, or with the error of the context if the caller goes away.
+func (f *fetcher) admit(ctx context.Context, req *fetchRequest) error {
+	var timeout <-chan time.Time
+	for {
+		f.lock.Lock()
+		_, shared := f.currentRequests[req.name]
+		if shared || f.queue.maxPending == 0 || f.queue.depth() < f.queue.maxPending {
+			req.reserved = !shared
+			if req.reserved {
+				f.queue.reserved++
+			}
+			f.lock.Unlock()
+			return nil
+		}
+		changed := f.queue.changed
+		f.lock.Unlock()
+
+		if f.queue.wait <= 0 {
+			return EAGAIN
+		}
+		if timeout == nil {
+			timeout = time.After(f.queue.wait)
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return EAGAIN
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release gives up the room reserved for a request that won't be fetched
+func (f *fetcher) release(req *fetchRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.releaseLocked(req)
+}
+
+// releaseLocked is release with the fetcher lock held
+func (f *fetcher) releaseLocked(req *fetchRequest) {
+	if req.reserved {
+		req.reserved = false
+		f.queue.reserved--
+		f.queue.notify()
+	}
+}
+
+// abandon removes the request of a caller that went away. A fetch that nobody
+// is waiting for any more is canceled if it hasn't started yet.
+func (f *fetcher) abandon(req *fetchRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	req.abandoned = true
+	requests := f.currentRequests[req.name]
+	for i, r := range requests {
+		if r == req {
+			requests = append(requests[:i], requests[i+1:]...)
+			break
+		}
+	}
+	if _, ok := f.currentRequests[req.name]; ok {
+		f.currentRequests[req.name] = requests
+	}
+
+	cancel, ok := f.cancelChans[req.name]
+	if ok && len(requests) == 0 && f.queue.queued[req.name] && !isCanceled(cancel) {
+		close(cancel)
+	}
+}
+
+// startQueued moves a fetch from the queue to the fetches in flight once it
+// has a concurrency slot
+func (f *fetcher) startQueued(req *fetchRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.queue.queued, req.name)
+	f.queue.inFlight++
+	f.queue.notify()
+}
+
+// endInFlight removes a fetch from the fetches in flight
+func (f *fetcher) endInFlight(req *fetchRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.queue.inFlight--
+}
+
+// dropQueued removes a fetch that stopped before it started from the queue
+func (f *fetcher) dropQueued(req *fetchRequest) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.queue.queued, req.name)
+	f.queue.notify()
+}
+
+// queueStats returns the state of the fetch queue
+func (f *fetcher) queueStats() *FetchQueue {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	queued := make([]string, 0, len(f.queue.queued))
+	for name := range f.queue.queued {
+		queued = append(queued, name)
+	}
+	sort.Strings(queued)
+	return &FetchQueue{
+		Depth:       f.queue.depth(),
+		MaxPending:  f.queue.maxPending,
+		InFlight:    f.queue.inFlight,
+		Concurrency: uint(cap(f.concurrentChan)),
+		Queued:      queued,
+	}
+}
+
+// GetFetchQueue retrieves how many fetches are waiting to start and in
+// progress
+func (store *ImageStore) GetFetchQueue(r *http.Request, request *FetchQueueRequest, response *FetchQueueResponse) error {
+	*response = FetchQueueResponse{
+		Queue: store.fetcher.queueStats(),
+	}
+	return nil
+}
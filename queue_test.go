@@ -0,0 +1,109 @@
+package imagestore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/stretchr/testify/suite"
+)
+
+type QueueTestSuite struct {
+	APITestSuite
+}
+
+func TestQueueTestSuite(t *testing.T) {
+	s := new(QueueTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *QueueTestSuite) configure(config *imagestore.Config) {
+	// One fetch at a time, with room for one more to wait
+	config.NumFetchers = 1
+	config.MaxPending = 1
+	config.QueueWait = 200 * time.Millisecond
+}
+
+// queue returns the state of the fetch queue
+func (s *QueueTestSuite) queue() *imagestore.FetchQueue {
+	response := &imagestore.FetchQueueResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetFetchQueue", &imagestore.FetchQueueRequest{}, response))
+	return response.Queue
+}
+
+// waitForQueue polls the fetch queue until it has the expected depth
+func (s *QueueTestSuite) waitForQueue(depth uint) *imagestore.FetchQueue {
+	var queue *imagestore.FetchQueue
+	for i := 0; i < 100; i++ {
+		queue = s.queue()
+		if queue.Depth == depth {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return queue
+}
+
+func (s *QueueTestSuite) requestAsync(id string) error {
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: id},
+		Async:        true,
+	}
+	return s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{})
+}
+
+func (s *QueueTestSuite) TestAdmission() {
+	// Hold the only fetch slot
+	s.NoError(s.requestAsync("slowID"))
+	for i := 0; i < 100 && s.queue().InFlight == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue := s.queue()
+	s.Equal(uint(1), queue.InFlight, "should have the fetch in flight")
+	s.Equal(uint(1), queue.Concurrency)
+	s.Equal(uint(1), queue.MaxPending)
+
+	// A caller that goes away takes its queued request with it
+	body, _ := json.Marshal(map[string]interface{}{
+		"method": "ImageStore.RequestImage",
+		"params": []interface{}{&rpc.ImageRequest{ID: s.ImageID}},
+		"id":     0,
+	})
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	_, err := client.Post(fmt.Sprintf("http://localhost:%d/_mistify_RPC_", s.Port), "application/json", bytes.NewReader(body))
+	s.Error(err, "should time out waiting for the fetch")
+	s.Equal(uint(0), s.waitForQueue(0).Depth, "should remove the abandoned request")
+	if image := s.waitForImage(s.ImageID); image != nil {
+		s.Equal(imagestore.ImageStatusFailed, image.Status, "should not leave the image pending")
+		s.Equal(imagestore.ErrCanceled.Error(), image.Error)
+	}
+
+	// Fill the queue
+	s.NoError(s.requestAsync(s.ImageID))
+	queue = s.waitForQueue(1)
+	s.Equal(uint(1), queue.Depth, "should queue the fetch")
+	s.Equal([]string{s.ImageID}, queue.Queued)
+
+	// Requests for the queued image share its fetch
+	s.NoError(s.requestAsync(s.ImageID), "should admit a request for a queued image")
+
+	start := time.Now()
+	err = s.requestAsync("gzipID")
+	s.Error(err, "should turn away a fetch when the queue is full")
+	if err != nil {
+		s.Contains(err.Error(), imagestore.EAGAIN.Error())
+	}
+	s.True(time.Since(start) >= s.StoreConfig.QueueWait, "should wait for room first")
+
+	// Canceling the fetch in flight makes room
+	cancel := &rpc.ImageRequest{ID: "slowID"}
+	s.NoError(s.Client.Do("ImageStore.CancelImageRequest", cancel, &imagestore.ImageResponse{}))
+	s.Equal(imagestore.ImageStatusComplete, s.waitForImage(s.ImageID).Status)
+	s.NoError(s.requestAsync("gzipID"), "should admit a fetch once there's room")
+}
@@ -0,0 +1,317 @@
+package imagestore
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/kvite"
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+const (
+	// defaultReconcileInterval is how often image records are reconciled
+	// with datasets when no interval is configured
+	defaultReconcileInterval = time.Hour
+	// staleTempAge is how long a temporary file of an image that isn't being
+	// fetched is kept, so a failed download can still be resumed
+	staleTempAge = 24 * time.Hour
+)
+
+// Reconcile actions
+const (
+	ReconcileMissing      = "missing"       // record marked missing, its datasets are gone
+	ReconcileAdopt        = "adopt"         // record created for an orphan image volume
+	ReconcileRemoveTemp   = "remove-temp"   // stale temporary file removed
+	ReconcileRemoveExport = "remove-export" // clone left behind by a disk export destroyed
+)
+
+type (
+	// ReconcileRequest is the request for ReconcileImages
+	ReconcileRequest struct {
+		DryRun bool `json:"dryRun"` // report changes without making them
+	}
+
+	// ReconcileChange is a change made, or that would be made, to bring image
+	// records and datasets in line
+	ReconcileChange struct {
+		Action string `json:"action"`
+		ID     string `json:"id,omitempty"` // image
+		Name   string `json:"name"`         // dataset or file
+	}
+
+	// ReconcileResponse is the response for ReconcileImages
+	ReconcileResponse struct {
+		DryRun  bool               `json:"dryRun"`
+		Changes []*ReconcileChange `json:"changes"`
+	}
+
+	// reconciler periodically reconciles image records with datasets
+	reconciler struct {
+		timeToDie chan struct{}
+		store     *ImageStore
+		interval  time.Duration
+	}
+)
+
+func newReconciler(store *ImageStore, interval time.Duration) *reconciler {
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+	return &reconciler{
+		timeToDie: make(chan struct{}),
+		store:     store,
+		interval:  interval,
+	}
+}
+
+// Run reconciles periodically
+func (c *reconciler) Run() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.timeToDie:
+				return
+			case <-ticker.C:
+				if _, err := c.store.reconcile(false); err != nil {
+					log.WithField("error", err).Error("failed to reconcile images")
+				}
+			}
+		}
+	}()
+}
+
+// Exit stops reconciling
+func (c *reconciler) Exit() {
+	var q struct{}
+	c.timeToDie <- q
+}
+
+// reconcile brings image records in line with the datasets under the image
+// store: records of images whose volume or snapshot is gone are marked
+// missing, orphan image volumes are adopted, and stale temporary files and
+// export clones are removed. Nothing is changed on a dry run.
+func (store *ImageStore) reconcile(dryRun bool) ([]*ReconcileChange, error) {
+	changes := []*ReconcileChange{}
+
+	images, err := store.listImages()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*Image, len(images))
+	for _, image := range images {
+		records[image.ID] = image
+	}
+
+	// Records without datasets
+	for _, image := range images {
+		if image.Status != ImageStatusComplete {
+			continue
+		}
+		for _, name := range []string{image.Volume, image.Snapshot} {
+			// An empty name isn't valid to look up, and a complete image
+			// without one is as good as missing
+			reason := "image has no volume or snapshot"
+			if name != "" {
+				if _, err := zfs.GetDataset(name); err == nil || !isZfsNotFound(err) {
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				reason = name + " does not exist"
+			}
+			if dryRun {
+				changes = append(changes, &ReconcileChange{Action: ReconcileMissing, ID: image.ID, Name: name})
+				break
+			}
+			marked, err := store.markMissing(image, reason)
+			if err != nil {
+				return nil, err
+			}
+			if marked {
+				changes = append(changes, &ReconcileChange{Action: ReconcileMissing, ID: image.ID, Name: name})
+			}
+			break
+		}
+	}
+
+	// Datasets without records
+	orphans, err := store.orphanImages(records)
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		changes = append(changes, &ReconcileChange{Action: ReconcileAdopt, ID: orphan.ID, Name: orphan.Volume})
+		if !dryRun {
+			record := records[orphan.ID]
+			if err := store.updateImage(orphan.ID, func(image *Image) {
+				if record == nil {
+					*image = *orphan
+					return
+				}
+				// Labels, aliases, history and the like are only kept in
+				// the record, so only what comes from the datasets is
+				// taken from them
+				image.Volume = orphan.Volume
+				image.Snapshot = orphan.Snapshot
+				image.Size = orphan.Size
+				image.Status = orphan.Status
+				image.Error = ""
+				if orphan.Checksum != "" {
+					image.Checksum = orphan.Checksum
+				}
+				image.SendChecksum = orphan.SendChecksum
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Temporary files
+	files, err := ioutil.ReadDir(store.tempDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		id := tempFileImage(fi.Name())
+		if fi.IsDir() || store.fetcher.fetching(id) {
+			continue
+		}
+		// Downloads of images that have been imported are never resumed
+		image := records[id]
+		imported := image != nil && image.Status == ImageStatusComplete
+		if !imported && time.Since(fi.ModTime()) < staleTempAge {
+			continue
+		}
+		filename := filepath.Join(store.tempDir, fi.Name())
+		changes = append(changes, &ReconcileChange{Action: ReconcileRemoveTemp, ID: id, Name: filename})
+		if !dryRun {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	// Clones of exports that were interrupted
+	exports, err := zfs.GetDataset(store.exportDataset)
+	if err != nil {
+		return nil, err
+	}
+	clones, err := exports.Children(1)
+	if err != nil {
+		return nil, err
+	}
+	for _, clone := range clones {
+		if store.exports.active(clone.Name) {
+			continue
+		}
+		changes = append(changes, &ReconcileChange{Action: ReconcileRemoveExport, Name: clone.Name})
+		if !dryRun {
+			if err := clone.Destroy(false); err != nil && !isZfsNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+
+	for _, change := range changes {
+		log.WithFields(log.Fields{
+			"action": change.Action,
+			"image":  change.ID,
+			"name":   change.Name,
+			"dryRun": dryRun,
+		}).Info("reconciled image")
+	}
+	return changes, nil
+}
+
+// orphanImages builds records for the image volumes identified by their user
+// properties that have no usable record
+func (store *ImageStore) orphanImages(records map[string]*Image) ([]*Image, error) {
+	images, err := store.datasetImages()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []*Image
+	for _, image := range images {
+		if store.fetcher.fetching(image.ID) {
+			continue
+		}
+		if record := records[image.ID]; record != nil && (record.Status == ImageStatusComplete || record.inProgress()) {
+			continue
+		}
+		orphans = append(orphans, image)
+	}
+	return orphans, nil
+}
+
+// markMissing marks the record of an image whose datasets are gone missing.
+// The image may have been deleted or fetched again since it was listed, so
+// it is only marked if its record is still there and still complete with the
+// same datasets. It returns whether the image was marked.
+func (store *ImageStore) markMissing(listed *Image, reason string) (bool, error) {
+	unlock := store.imageLocks.acquire(listed.ID)
+	defer unlock()
+
+	var marked *Image
+	err := store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil || b == nil {
+			return err
+		}
+		image, err := getImageTx(b, listed.ID)
+		if err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		if image.Status != ImageStatusComplete || image.Volume != listed.Volume || image.Snapshot != listed.Snapshot {
+			return nil
+		}
+		image.Status = ImageStatusMissing
+		image.Error = reason
+		marked = image
+		return putImageTx(b, image)
+	})
+	if err != nil {
+		return false, err
+	}
+	// The volume may be all that's left, and keeps the status too
+	if marked != nil && marked.Volume != "" {
+		saveImageProperties(marked)
+	}
+	return marked != nil, nil
+}
+
+// tempFileImage gets the image ID out of the name of a temporary file of a
+// fetch
+func tempFileImage(name string) string {
+	for _, suffix := range []string{".partial.validator", ".partial", ".disk"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// ReconcileImages brings image records in line with the datasets of the
+// image store, or reports what would change on a dry run
+func (store *ImageStore) ReconcileImages(r *http.Request, request *ReconcileRequest, response *ReconcileResponse) error {
+	changes, err := store.reconcile(request.DryRun)
+	if err != nil {
+		return err
+	}
+
+	*response = ReconcileResponse{
+		DryRun:  request.DryRun,
+		Changes: changes,
+	}
+	return nil
+}
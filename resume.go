@@ -0,0 +1,100 @@
+package imagestore
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// ReceiveStateRequest is the request for GetReceiveState and AbortReceive
+	ReceiveStateRequest struct {
+		ID string `json:"id"` // dataset a stream was received into
+	}
+
+	// ReceiveStateResponse is the response for GetReceiveState and
+	// AbortReceive
+	ReceiveStateResponse struct {
+		ID    string `json:"id"`
+		Token string `json:"token"` // receive_resume_token, empty if there's no partial receive
+	}
+)
+
+// receiveDataset looks up the dataset of a resumable receive. Partial
+// receives of full streams leave an inconsistent dataset behind, and of
+// incremental streams a hidden %recv child, but the token is on the dataset
+// either way.
+func (store *ImageStore) receiveDataset(id string) (string, string, error) {
+	if id == "" {
+		return "", "", errors.New("need an id")
+	}
+	if strings.Contains(id, "@") || !validDatasetName(id) {
+		return "", "", ErrNotValid
+	}
+
+	name := filepath.Join(store.config.Zpool, id)
+	props, err := zfsProperties(name, "receive_resume_token")
+	if err != nil {
+		if isZfsNotFound(err) {
+			return "", "", ErrNotFound
+		}
+		if isZfsInvalid(err) {
+			return "", "", ErrNotValid
+		}
+		return "", "", err
+	}
+
+	token := props["receive_resume_token"]
+	if token == "-" {
+		token = ""
+	}
+	return name, token, nil
+}
+
+/*
+GetReceiveState retrieves the resume token of a partial receive through
+/snapshots/upload with resumable set. A sender continues the transfer with a
+resumed send stream, like the one /snapshots/download returns for the token.
+
+	Request params:
+	id        string : Req : Dataset the stream was received into
+*/
+func (store *ImageStore) GetReceiveState(r *http.Request, request *ReceiveStateRequest, response *ReceiveStateResponse) error {
+	name, token, err := store.receiveDataset(request.ID)
+	if err != nil {
+		return err
+	}
+
+	*response = ReceiveStateResponse{
+		ID:    name,
+		Token: token,
+	}
+	return nil
+}
+
+/*
+AbortReceive discards the state of a partial receive, so the transfer can
+only be started over.
+
+	Request params:
+	id        string : Req : Dataset the stream was received into
+*/
+func (store *ImageStore) AbortReceive(r *http.Request, request *ReceiveStateRequest, response *ReceiveStateResponse) error {
+	name, token, err := store.receiveDataset(request.ID)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("no partial receive to abort")
+	}
+
+	if err := zfsCommand(nil, nil, "receive", "-A", name); err != nil {
+		return err
+	}
+
+	*response = ReceiveStateResponse{
+		ID: name,
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package imagestore
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Retry policy defaults, used for any unset RetryConfig fields
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// defaultRetryableCodes are the http response codes that are retried by default
+var defaultRetryableCodes = []int{408, 429, 500, 502, 503, 504}
+
+// RetryConfig configures how downloads that fail for transient reasons are
+// retried. A retried download resumes where the failed one left off if the
+// source supports it.
+type RetryConfig struct {
+	MaxAttempts int // total attempts, including the first
+	// Backoff before the second attempt, doubling with each further attempt
+	// up to MaxBackoff. A random jitter of up to half is taken off.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// HTTP response codes to retry. Connection errors and interrupted
+	// downloads are always retried.
+	RetryableCodes []int
+}
+
+// withDefaults fills in any unset fields with the defaults
+func (config RetryConfig) withDefaults() RetryConfig {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaultInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.RetryableCodes == nil {
+		config.RetryableCodes = defaultRetryableCodes
+	}
+	return config
+}
+
+// backoff returns how long to wait after a failed attempt, starting from 1
+func (config RetryConfig) backoff(attempt int) time.Duration {
+	backoff := config.InitialBackoff << uint(attempt-1)
+	if backoff > config.MaxBackoff || backoff <= 0 {
+		backoff = config.MaxBackoff
+	}
+	// Spread out retries of fetches that failed together
+	if half := int64(backoff / 2); half > 0 {
+		backoff -= time.Duration(rand.Int63n(half))
+	}
+	return backoff
+}
+
+// isRetryable determines whether a download error is transient
+func (config RetryConfig) isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *url.Error, net.Error:
+		return true
+	case ErrorHTTPCode:
+		for _, code := range config.RetryableCodes {
+			if e.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	return err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,181 @@
+package imagestore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// serverBackoff is how long an image server is skipped after its first
+	// failure. It doubles with each consecutive failure up to maxServerBackoff.
+	serverBackoff    = 10 * time.Second
+	maxServerBackoff = 5 * time.Minute
+)
+
+type (
+	// fetchLocation is one place an image can be fetched from
+	fetchLocation struct {
+		mirror    string      // image server host:port, empty for other sources
+		pool      *serverPool // pool the mirror is from, tracking its health
+		peer      bool        // mirror is a peer agent, tried before the image servers
+		source    string
+		checksum  string
+		signature string
+	}
+
+	// serverPool tracks the health of the image servers so failing ones are
+	// tried last until they have had time to recover
+	serverPool struct {
+		servers []string
+
+		lock   sync.Mutex
+		health map[string]*serverHealth
+	}
+
+	// serverAddr is the resolved address of an image server
+	serverAddr struct {
+		scheme   string
+		hostport string
+	}
+
+	// serverHealth is the failure history of an image server
+	serverHealth struct {
+		failures uint
+		retryAt  time.Time
+	}
+)
+
+// newServerPool creates a pool of image servers, given as host:port or as a
+// host name for an SRV lookup, optionally prefixed with http:// or https://
+func newServerPool(servers []string) *serverPool {
+	return &serverPool{
+		servers: servers,
+		health:  make(map[string]*serverHealth),
+	}
+}
+
+// resolve expands the image servers to host:port pairs, with every target of
+// an SRV record in priority and weight order
+func (p *serverPool) resolve() ([]serverAddr, error) {
+	var addrs []serverAddr
+	for _, server := range p.servers {
+		scheme := "http"
+		if i := strings.Index(server, "://"); i >= 0 {
+			scheme, server = server[:i], server[i+3:]
+		}
+
+		if _, _, err := net.SplitHostPort(server); err == nil {
+			addrs = append(addrs, serverAddr{scheme: scheme, hostport: server})
+			continue
+		}
+
+		_, records, err := net.LookupSRV("", "", server)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"server": server,
+			}).Error("failed to look up image server")
+			continue
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			addrs = append(addrs, serverAddr{
+				scheme:   scheme,
+				hostport: net.JoinHostPort(target, fmt.Sprint(record.Port)),
+			})
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no image servers available")
+	}
+	return addrs, nil
+}
+
+// locations returns where an image can be fetched from, with healthy image
+// servers first and unhealthy ones ordered by when they may have recovered
+func (p *serverPool) locations(id string) ([]fetchLocation, error) {
+	addrs, err := p.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	now := time.Now()
+	retryAt := make(map[string]time.Time, len(addrs))
+	for _, addr := range addrs {
+		if health, ok := p.health[addr.hostport]; ok && health.retryAt.After(now) {
+			retryAt[addr.hostport] = health.retryAt
+		}
+	}
+	p.lock.Unlock()
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return retryAt[addrs[i].hostport].Before(retryAt[addrs[j].hostport])
+	})
+
+	locations := make([]fetchLocation, len(addrs))
+	for i, addr := range addrs {
+		base := fmt.Sprintf("%s://%s/images/%s", addr.scheme, addr.hostport, url.PathEscape(id))
+		locations[i] = fetchLocation{
+			mirror:    addr.hostport,
+			pool:      p,
+			source:    base + "/download",
+			checksum:  base + "/checksum",
+			signature: base + "/signature",
+		}
+	}
+	return locations, nil
+}
+
+// markFailed backs off from an image server after a failure
+func (p *serverPool) markFailed(hostport string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	health, ok := p.health[hostport]
+	if !ok {
+		health = &serverHealth{}
+		p.health[hostport] = health
+	}
+	backoff := serverBackoff << health.failures
+	if backoff > maxServerBackoff || backoff <= 0 {
+		backoff = maxServerBackoff
+	}
+	health.failures++
+	health.retryAt = time.Now().Add(backoff)
+
+	log.WithFields(log.Fields{
+		"server":   hostport,
+		"failures": health.failures,
+		"backoff":  backoff,
+	}).Warning("image server marked unhealthy")
+}
+
+// markHealthy clears the failure history of an image server
+func (p *serverPool) markHealthy(hostport string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.health, hostport)
+}
+
+// isFailoverError determines whether a fetch error is the fault of the server
+// it was fetched from, so another server should be tried
+func isFailoverError(err error) bool {
+	switch e := err.(type) {
+	case *url.Error, net.Error:
+		return true
+	case ErrorHTTPCode:
+		return e.Code >= 500
+	}
+	return false
+}
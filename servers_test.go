@@ -0,0 +1,58 @@
+package imagestore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServersTestSuite struct {
+	APITestSuite
+	DownServer *httptest.Server
+	// requests the down server received, updated atomically
+	DownServerHits int32
+}
+
+func TestServersTestSuite(t *testing.T) {
+	s := new(ServersTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *ServersTestSuite) configure(config *imagestore.Config) {
+	// An image server that is always unavailable, tried before the working one
+	s.DownServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.DownServerHits, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	downURL, _ := url.Parse(s.DownServer.URL)
+	config.ImageServers = []string{downURL.Host, config.ImageServer}
+}
+
+func (s *ServersTestSuite) TearDownSuite() {
+	s.DownServer.Close()
+}
+
+func (s *ServersTestSuite) TestFailover() {
+	atomic.StoreInt32(&s.DownServerHits, 0)
+
+	response := &imagestore.ImageResponse{}
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal(imagestore.ImageStatusComplete, response.Images[0].Status)
+	s.Equal(s.StoreConfig.ImageServer, response.Images[0].Mirror, "should record the working mirror")
+	s.Equal(int32(1), atomic.LoadInt32(&s.DownServerHits))
+
+	// The failed server should now be tried last
+	request.ID = "gzipID"
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Equal(s.StoreConfig.ImageServer, response.Images[0].Mirror)
+	s.Equal(int32(1), atomic.LoadInt32(&s.DownServerHits), "unhealthy server should not be tried first")
+}
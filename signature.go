@@ -0,0 +1,262 @@
+package imagestore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"golang.org/x/crypto/openpgp"
+)
+
+// maxSignatureSize limits how much of a signature response is read
+const maxSignatureSize = 64 * 1024
+
+var (
+	// ErrNoSignature is an error when an image source has no signature for an
+	// image and a trust store is configured
+	ErrNoSignature = errors.New("image is not signed")
+	// ErrUntrustedSignature is an error when an image signature can't be
+	// verified by any key in the trust store
+	ErrUntrustedSignature = errors.New("image signature not verified by any trusted key")
+)
+
+type (
+	// trustStore holds the public keys images are required to be signed with.
+	// ed25519 signatures are made over the raw sha256 digest of the image,
+	// PGP signatures are regular detached signatures of the image itself.
+	trustStore struct {
+		dir     string
+		ed25519 map[string]ed25519.PublicKey
+		pgp     openpgp.EntityList
+	}
+
+	// pgpCheck verifies a PGP signature of data written to it
+	pgpCheck struct {
+		writer *io.PipeWriter
+		result chan pgpResult
+	}
+
+	pgpResult struct {
+		keyID string
+		err   error
+	}
+
+	// ErrorRejected should be used for errors resulting from an image failing
+	// signature verification
+	ErrorRejected struct {
+		ID     string
+		Reason error
+	}
+)
+
+// Error returns a string error message
+func (e ErrorRejected) Error() string {
+	return fmt.Sprintf("image %s rejected: %s", e.ID, e.Reason)
+}
+
+// loadTrustStore reads all public keys in a directory. Files ending in .asc or
+// .gpg are PGP keyrings, anything else is expected to be an ed25519 public key,
+// either PEM encoded or raw base64, identified by its file name.
+func loadTrustStore(dir string) (*trustStore, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &trustStore{
+		dir:     dir,
+		ed25519: make(map[string]ed25519.PublicKey),
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		filename := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		ext := filepath.Ext(fi.Name())
+		switch ext {
+		case ".asc":
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			ts.pgp = append(ts.pgp, entities...)
+		case ".gpg":
+			entities, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			ts.pgp = append(ts.pgp, entities...)
+		default:
+			key, err := parseEd25519PublicKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			ts.ed25519[strings.TrimSuffix(fi.Name(), ext)] = key
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dir":     dir,
+		"ed25519": len(ts.ed25519),
+		"pgp":     len(ts.pgp),
+	}).Info("loaded trust store")
+	return ts, nil
+}
+
+// parseEd25519PublicKey decodes a PEM or base64 encoded ed25519 public key
+func parseEd25519PublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 public key")
+		}
+		return key, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("not an ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verify checks a detached signature of a downloaded image, returning the ID
+// of the key that made it
+func (ts *trustStore) verify(filename, checksum string, signature []byte) (string, error) {
+	if isPGPSignature(signature) {
+		file, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer logx.LogReturnedErr(file.Close, log.Fields{
+			"filename": filename,
+		}, "failed to close file")
+
+		return ts.verifyPGP(file, signature)
+	}
+	return ts.verifyEd25519(checksum, signature)
+}
+
+// isPGPSignature determines whether a signature is a PGP signature, either
+// armored or a binary packet
+func isPGPSignature(signature []byte) bool {
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE")) {
+		return true
+	}
+	// Binary packets always have the high bit of the tag byte set. Raw
+	// ed25519 signatures are exactly 64 bytes and base64 text never does.
+	return len(signature) > 0 && signature[0]&0x80 != 0 && len(signature) != ed25519.SignatureSize
+}
+
+func (ts *trustStore) verifyPGP(signed io.Reader, signature []byte) (string, error) {
+	if len(ts.pgp) == 0 {
+		return "", ErrUntrustedSignature
+	}
+
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+
+	signer, err := check(ts.pgp, signed, bytes.NewReader(signature))
+	if err != nil {
+		log.WithField("error", err).Warning("pgp signature check failed")
+		return "", ErrUntrustedSignature
+	}
+	return signer.PrimaryKey.KeyIdString(), nil
+}
+
+// startPGPCheck verifies a PGP signature of an image as it is written, for
+// images that are not staged on disk. The result is available from wait once
+// the whole image has been written.
+func (ts *trustStore) startPGPCheck(signature []byte) *pgpCheck {
+	reader, writer := io.Pipe()
+	c := &pgpCheck{
+		writer: writer,
+		result: make(chan pgpResult, 1),
+	}
+	go func() {
+		keyID, err := ts.verifyPGP(reader, signature)
+		// Keep consuming so writes don't block if the check ended early
+		_, _ = io.Copy(ioutil.Discard, reader)
+		c.result <- pgpResult{keyID: keyID, err: err}
+	}()
+	return c
+}
+
+// Write passes image data on to the signature check
+func (c *pgpCheck) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// wait ends the image data and returns the ID of the key that signed it
+func (c *pgpCheck) wait() (string, error) {
+	if err := c.writer.Close(); err != nil {
+		return "", err
+	}
+	result := <-c.result
+	return result.keyID, result.err
+}
+
+func (ts *trustStore) verifyEd25519(checksum string, signature []byte) (string, error) {
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return "", errors.New("malformed image signature")
+		}
+		signature = decoded
+	}
+
+	digest, err := hex.DecodeString(strings.TrimPrefix(checksum, checksumPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	for keyID, key := range ts.ed25519 {
+		if ed25519.Verify(key, digest, signature) {
+			return keyID, nil
+		}
+	}
+	return "", ErrUntrustedSignature
+}
+
+// fetchSignature retrieves the detached signature for an image
+func (f *fetcher) fetchSignature(location string) ([]byte, error) {
+	if location == "" {
+		return nil, ErrNoSignature
+	}
+
+	signature, err := f.readSmall(location, maxSignatureSize)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrNoSignature
+		}
+		return nil, err
+	}
+	return signature, nil
+}
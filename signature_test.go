@@ -0,0 +1,75 @@
+package imagestore_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+)
+
+type SignatureTestSuite struct {
+	APITestSuite
+	TrustStoreDir string
+}
+
+func TestSignatureTestSuite(t *testing.T) {
+	s := new(SignatureTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *SignatureTestSuite) configure(config *imagestore.Config) {
+	// Trust the key the fake image service signs with
+	var err error
+	s.TrustStoreDir, err = ioutil.TempDir("", "SignatureTestSuite-")
+	s.Require().NoError(err)
+	publicKey := s.SigningKey.Public().(ed25519.PublicKey)
+	keyData := []byte(base64.StdEncoding.EncodeToString(publicKey))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(s.TrustStoreDir, "build.pub"), keyData, 0644))
+	config.TrustStore = s.TrustStoreDir
+}
+
+func (s *SignatureTestSuite) TearDownSuite() {
+	logx.LogReturnedErr(func() error { return os.RemoveAll(s.TrustStoreDir) },
+		nil, "unable to remove dir "+s.TrustStoreDir)
+}
+
+func (s *SignatureTestSuite) TestSignedImage() {
+	response := &imagestore.ImageResponse{}
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal("complete", response.Images[0].Status)
+	s.True(response.Images[0].Verified)
+	s.Equal("build", response.Images[0].SigningKey)
+}
+
+func (s *SignatureTestSuite) TestUnsignedImage() {
+	response := &imagestore.ImageResponse{}
+	request := &rpc.ImageRequest{ID: "gzipID"}
+	s.Error(s.Client.Do("ImageStore.RequestImage", request, response))
+
+	response = &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, response))
+	s.Len(response.Images, 1)
+	s.Equal("rejected", response.Images[0].Status)
+	s.False(response.Images[0].Verified)
+	s.NotEmpty(response.Images[0].Error)
+}
+
+func (s *SignatureTestSuite) TestStreamedImage() {
+	response := &imagestore.ImageResponse{}
+	request := &imagestore.ImageRequest{
+		ImageRequest: rpc.ImageRequest{ID: s.ImageID},
+		ImportMode:   imagestore.ImportModeStream,
+	}
+	s.Error(s.Client.Do("ImageStore.RequestImage", request, response), "should not stream an image it has to verify")
+	s.Error(s.Client.Do("ImageStore.GetImage", &rpc.ImageRequest{ID: s.ImageID}, response), "should not fetch the image")
+}
@@ -1,14 +1,18 @@
 package imagestore
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
 	"gopkg.in/mistifyio/go-zfs.v1"
 )
 
@@ -244,31 +248,51 @@ func (store *ImageStore) RollbackSnapshot(r *http.Request, request *rpc.Snapshot
 	return nil
 }
 
+// SnapshotDownloadRequest is the request for DownloadSnapshot
+type SnapshotDownloadRequest struct {
+	rpc.SnapshotRequest
+	From         string `json:"from"`         // base snapshot or bookmark of an incremental stream
+	Intermediate bool   `json:"intermediate"` // include the snapshots between from and id
+	Token        string `json:"token"`        // receive_resume_token of a partial receive to resume
+}
+
 /*
-DownloadSnapshot downloads a zfs snapshot as a stream of data
+DownloadSnapshot downloads a zfs snapshot as a stream of data. With a base
+snapshot or bookmark it downloads an incremental stream, and with the resume
+token of a partial receive the rest of the stream that was interrupted.
     Request params:
-    id        string : Req : Full name of the snapshot
+    id           string : Req : Full name of the snapshot
+    from         string :     : Base snapshot or bookmark, full or starting with @ or #
+    intermediate bool   :     : Include intermediate snapshots, like zfs send -I
+    token        string :     : Resume token, instead of the other params
 */
 func (store *ImageStore) DownloadSnapshot(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var request rpc.SnapshotRequest
+	var request SnapshotDownloadRequest
 	err := decoder.Decode(&request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if request.Token != "" {
+		store.resumeSend(w, request.Token)
+		return
+	}
 	if request.ID == "" {
 		http.Error(w, "need an id", http.StatusBadRequest)
 		return
 	}
 
 	s, err := store.getSnapshot(request.ID)
+	if err == nil && request.From != "" {
+		err = store.checkIncrementalBase(s.Name, request.From, request.Intermediate)
+	}
 	if err != nil {
-		if err == ErrNotFound {
+		if err == ErrNotFound || err == ErrBaseNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		if err == ErrNotSnapshot || err == ErrNotValid {
+		if err == ErrNotSnapshot || err == ErrNotValid || err == ErrNotAncestor || err == ErrBookmarkIntermediate {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -277,9 +301,251 @@ func (store *ImageStore) DownloadSnapshot(w http.ResponseWriter, r *http.Request
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	err = s.SendSnapshot(w)
+	if request.From == "" {
+		err = s.SendSnapshot(w)
+	} else {
+		flag := "-i"
+		if request.Intermediate {
+			flag = "-I"
+		}
+		err = zfsCommand(nil, w, "send", flag, store.incrementalBase(s.Name, request.From), s.Name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+UploadSnapshot receives a full or incremental zfs send stream into a dataset
+under guests. The stream is the body of the request, so the params are in the
+query string. Compressed streams are decompressed.
+
+	Query params:
+	id          string : Req : Dataset under guests to receive into, optionally with a snapshot name
+	force       bool   :     : Roll back the dataset to the latest snapshot first, like zfs receive -F
+	resumable   bool   :     : Keep the state of an interrupted receive so it can be resumed, like zfs receive -s
+	compression string :     : Compression of the stream, if it can't be detected
+	prune       string :     : Destroy the other snapshots of the dataset whose names start with this after the receive
+*/
+func (store *ImageStore) UploadSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	id := query.Get("id")
+	if id == "" {
+		http.Error(w, "need an id", http.StatusBadRequest)
+		return
+	}
+	// Uploads would otherwise be able to create or roll back datasets
+	// anywhere, including the image store
+	if !validDatasetName(id) || !strings.HasPrefix(id, "guests/") {
+		http.Error(w, ErrNotValid.Error(), http.StatusBadRequest)
+		return
+	}
+	force, _ := strconv.ParseBool(query.Get("force"))
+	resumable, _ := strconv.ParseBool(query.Get("resumable"))
+	hint := query.Get("compression")
+	if hint == "" {
+		hint = compressionHint(r.Header)
+	}
+
+	stream, _, err := decompress(r.Body, hint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer logx.LogReturnedErr(stream.Close, nil, "failed to close upload stream")
+
+	name := filepath.Join(store.config.Zpool, id)
+	// zfs receive doesn't create missing parents of the dataset
+	if parent := filepath.Dir(strings.SplitN(name, "@", 2)[0]); parent != store.config.Zpool {
+		if err := zfsCommand(nil, nil, "create", "-p", parent); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	args := []string{"receive"}
+	if force {
+		args = append(args, "-F")
+	}
+	if resumable {
+		args = append(args, "-s")
+	}
+	if err := zfsCommand(stream, nil, append(args, name)...); err != nil {
+		if isZfsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if strings.Contains(err.Error(), "exists") || strings.Contains(err.Error(), "has been modified") {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dataset := strings.SplitN(name, "@", 2)[0]
+	snapshot, err := latestSnapshot(dataset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if prefix := query.Get("prune"); prefix != "" {
+		keep := strings.SplitN(snapshot.Name, "@", 2)[1]
+		if err := pruneSnapshots(dataset, prefix, keep); err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"dataset": dataset,
+			}).Warning("failed to prune snapshots")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshotFromDataset(snapshot)); err != nil {
+		log.WithField("error", err).Error("failed to encode uploaded snapshot")
+	}
+}
+
+// validDatasetName checks a dataset name relative to the zpool, optionally
+// with a snapshot name
+func validDatasetName(id string) bool {
+	parts := strings.Split(id, "@")
+	if len(parts) > 2 || (len(parts) == 2 && !validName.MatchString(parts[1])) {
+		return false
+	}
+	for _, part := range strings.Split(parts[0], "/") {
+		if !validName.MatchString(part) || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// validIncrementalBase checks the base of an incremental stream, a snapshot or
+// bookmark relative to the zpool or of the same dataset when it starts with @
+// or #
+func validIncrementalBase(from string) bool {
+	if strings.HasPrefix(from, "@") || strings.HasPrefix(from, "#") {
+		return validName.MatchString(from[1:])
+	}
+	if parts := strings.Split(from, "#"); len(parts) == 2 {
+		return !strings.Contains(parts[0], "@") && validDatasetName(parts[0]) && validName.MatchString(parts[1])
+	}
+	return validDatasetName(from)
+}
+
+// latestSnapshot returns the most recent snapshot of a dataset, other than the
+// temporary snapshots of disk exports
+func latestSnapshot(dataset string) (*zfs.Dataset, error) {
+	var out bytes.Buffer
+	if err := zfsCommand(nil, &out, "list", "-H", "-d", "1", "-t", "snapshot", "-o", "name", "-s", "createtxg", dataset); err != nil {
+		return nil, err
+	}
+	names := strings.Fields(out.String())
+	for i := len(names) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(strings.SplitN(names[i], "@", 2)[1], exportSnapshotPrefix) {
+			return zfs.GetDataset(names[i])
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// resumeSend sends the rest of an interrupted stream from the resume token of
+// the partial receive
+func (store *ImageStore) resumeSend(w http.ResponseWriter, token string) {
+	// Check the token, which also makes sure the snapshot still exists,
+	// before sending any of the stream
+	var out bytes.Buffer
+	if err := zfsCommand(nil, &out, "send", "-n", "-P", "-t", token); err != nil {
+		if isZfsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := zfsCommand(nil, w, "send", "-t", token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// incrementalBase returns the full name of the base of an incremental stream.
+// A base starting with @ or # is a snapshot or bookmark of the same dataset.
+func (store *ImageStore) incrementalBase(snapshot, from string) string {
+	if strings.HasPrefix(from, "@") || strings.HasPrefix(from, "#") {
+		return strings.SplitN(snapshot, "@", 2)[0] + from
+	}
+	return filepath.Join(store.config.Zpool, from)
+}
+
+// checkIncrementalBase makes sure the base snapshot or bookmark of an
+// incremental stream is an ancestor of the snapshot, either an earlier
+// snapshot of the same dataset or of the origin of a clone
+func (store *ImageStore) checkIncrementalBase(snapshot, from string, intermediate bool) error {
+	if !validIncrementalBase(from) {
+		return ErrNotValid
+	}
+	base := store.incrementalBase(snapshot, from)
+	if strings.Contains(base, "#") {
+		if intermediate {
+			return ErrBookmarkIntermediate
+		}
+	} else if !strings.Contains(base, "@") {
+		return ErrNotSnapshot
+	}
+
+	baseTxg, err := createTxg(base)
+	if err != nil {
+		if isZfsNotFound(err) || isZfsInvalid(err) {
+			return ErrBaseNotFound
+		}
+		return err
+	}
+	baseDataset := strings.FieldsFunc(base, func(r rune) bool { return r == '@' || r == '#' })[0]
+
+	// Walk back through the origins of clones until the dataset of the base
+	// is reached. The base has to have been created before the snapshot, or
+	// the origin the clone was made from.
+	name := snapshot
+	inclusive := false
+	for {
+		txg, err := createTxg(name)
+		if err != nil {
+			return err
+		}
+		dataset := strings.SplitN(name, "@", 2)[0]
+		if dataset == baseDataset {
+			if baseTxg < txg || (inclusive && baseTxg == txg) {
+				return nil
+			}
+			return ErrNotAncestor
+		}
+
+		datasetProps, err := zfsProperties(dataset, "origin")
+		if err != nil {
+			return err
+		}
+		origin := datasetProps["origin"]
+		if origin == "" || origin == "-" {
+			return ErrNotAncestor
+		}
+		name = origin
+		inclusive = true
+	}
+}
+
+// createTxg returns the transaction group a snapshot or bookmark was created in
+func createTxg(name string) (uint64, error) {
+	props, err := zfsProperties(name, "createtxg")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(props["createtxg"], 10, 64)
 }
@@ -1,14 +1,20 @@
 package imagestore_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	imagestore "github.com/mistifyio/mistify-agent-image"
 	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/mistifyio/go-zfs.v1"
@@ -306,3 +312,202 @@ func (s *SnapshotTestSuite) TestDownload() {
 		}
 	}
 }
+
+func (s *SnapshotTestSuite) TestDownloadIncremental() {
+	baseName := s.createSnapshot(false)
+	snapshotName := s.createSnapshot(false)
+	// special client for the non-rpc call
+	client, _ := rpc.NewClient(uint(s.Port), "/snapshots/download")
+
+	otherFS := uuid.New()
+	other, err := zfs.CreateFilesystem(filepath.Join(s.ID, otherFS), defaultZFSOptions)
+	if s.NoError(err) {
+		_, err = other.Snapshot("other", false)
+		s.NoError(err)
+	}
+	s.NoError(exec.Command("zfs", "bookmark", s.getID(true, true, false, baseName), s.getID(true, true, false, "")+"#"+baseName).Run())
+
+	snapshotID := s.getID(false, true, false, snapshotName)
+	tests := []struct {
+		description        string
+		request            *imagestore.SnapshotDownloadRequest
+		expectedStatusCode int
+	}{
+		{"full name base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            s.getID(false, true, false, baseName),
+			}, http.StatusOK},
+		{"short name base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "@" + baseName,
+			}, http.StatusOK},
+		{"intermediate",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "@" + baseName,
+				Intermediate:    true,
+			}, http.StatusOK},
+		{"missing base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "@asdf",
+			}, http.StatusNotFound},
+		{"later base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: s.getID(false, true, false, baseName)},
+				From:            "@" + snapshotName,
+			}, http.StatusBadRequest},
+		{"unrelated base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            otherFS + "@other",
+			}, http.StatusBadRequest},
+		{"base not a snapshot",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            s.getID(false, true, false, ""),
+			}, http.StatusBadRequest},
+		{"base outside the zpool",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "../" + s.getID(true, true, false, baseName),
+			}, http.StatusBadRequest},
+		{"bookmark base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "#" + baseName,
+			}, http.StatusOK},
+		{"intermediate bookmark base",
+			&imagestore.SnapshotDownloadRequest{
+				SnapshotRequest: rpc.SnapshotRequest{ID: snapshotID},
+				From:            "#" + baseName,
+				Intermediate:    true,
+			}, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		response := httptest.NewRecorder()
+		client.DoRaw(test.request, response)
+		s.Equal(test.expectedStatusCode, response.Code, msg("should return expected http status code"))
+		if response.Code == http.StatusOK {
+			s.True(len(response.Body.Bytes()) > 0, msg("should return snapshot data"))
+		}
+	}
+}
+
+func (s *SnapshotTestSuite) TestUpload() {
+	baseName := s.createSnapshot(false)
+	snapshotName := s.createSnapshot(false)
+	downloadClient, _ := rpc.NewClient(uint(s.Port), "/snapshots/download")
+
+	full := httptest.NewRecorder()
+	downloadClient.DoRaw(&imagestore.SnapshotDownloadRequest{
+		SnapshotRequest: rpc.SnapshotRequest{ID: s.getID(false, true, false, baseName)},
+	}, full)
+	s.Equal(http.StatusOK, full.Code)
+
+	incremental := httptest.NewRecorder()
+	downloadClient.DoRaw(&imagestore.SnapshotDownloadRequest{
+		SnapshotRequest: rpc.SnapshotRequest{ID: s.getID(false, true, false, snapshotName)},
+		From:            "@" + baseName,
+	}, incremental)
+	s.Equal(http.StatusOK, incremental.Code)
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	_, _ = writer.Write(full.Body.Bytes())
+	_ = writer.Close()
+
+	dest := filepath.Join("guests", uuid.New())
+	tests := []struct {
+		description        string
+		id                 string
+		data               []byte
+		expectedStatusCode int
+		expectedID         string
+	}{
+		{"missing id",
+			"", full.Body.Bytes(), http.StatusBadRequest, ""},
+		{"invalid id",
+			"../" + dest, full.Body.Bytes(), http.StatusBadRequest, ""},
+		{"outside guests",
+			filepath.Join("images", uuid.New()), full.Body.Bytes(), http.StatusBadRequest, ""},
+		{"guests",
+			"guests", full.Body.Bytes(), http.StatusBadRequest, ""},
+		{"full",
+			dest, full.Body.Bytes(), http.StatusOK, dest + "@" + baseName},
+		{"existing dataset",
+			dest, full.Body.Bytes(), http.StatusConflict, ""},
+		{"incremental",
+			dest, incremental.Body.Bytes(), http.StatusOK, dest + "@" + snapshotName},
+		{"compressed and renamed",
+			dest + "-gzip@renamed", gzipped.Bytes(), http.StatusOK, dest + "-gzip@renamed"},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		url := fmt.Sprintf("http://localhost:%d/snapshots/upload?id=%s", s.Port, test.id)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(test.data))
+		if !s.NoError(err, msg("should not error")) {
+			continue
+		}
+		s.Equal(test.expectedStatusCode, resp.StatusCode, msg("should return expected http status code"))
+		if resp.StatusCode == http.StatusOK {
+			snapshot := &rpc.Snapshot{}
+			s.NoError(json.NewDecoder(resp.Body).Decode(snapshot), msg("should return the snapshot"))
+			s.Equal(filepath.Join(s.ID, test.expectedID), snapshot.ID, msg("should be the received snapshot"))
+		}
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	}
+}
+
+func (s *SnapshotTestSuite) TestResumeUpload() {
+	snapshotName := s.createSnapshot(false)
+	downloadClient, _ := rpc.NewClient(uint(s.Port), "/snapshots/download")
+	upload := func(id string, data []byte) int {
+		url := fmt.Sprintf("http://localhost:%d/snapshots/upload?resumable=true&id=%s", s.Port, id)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(data))
+		if !s.NoError(err) {
+			return 0
+		}
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		return resp.StatusCode
+	}
+
+	full := httptest.NewRecorder()
+	downloadClient.DoRaw(&imagestore.SnapshotDownloadRequest{
+		SnapshotRequest: rpc.SnapshotRequest{ID: s.getID(false, true, false, snapshotName)},
+	}, full)
+	s.Equal(http.StatusOK, full.Code)
+	partial := full.Body.Bytes()[:full.Body.Len()/2]
+
+	// Resume an interrupted upload
+	dest := filepath.Join("guests", uuid.New())
+	s.NotEqual(http.StatusOK, upload(dest, partial), "should fail to receive a partial stream")
+
+	state := &imagestore.ReceiveStateResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetReceiveState", &imagestore.ReceiveStateRequest{ID: dest}, state))
+	s.NotEmpty(state.Token, "should have a resume token")
+
+	resumed := httptest.NewRecorder()
+	downloadClient.DoRaw(&imagestore.SnapshotDownloadRequest{Token: state.Token}, resumed)
+	s.Equal(http.StatusOK, resumed.Code, "should send the rest of the stream")
+	s.Equal(http.StatusOK, upload(dest, resumed.Body.Bytes()), "should resume the receive")
+
+	s.NoError(s.Client.Do("ImageStore.GetReceiveState", &imagestore.ReceiveStateRequest{ID: dest}, state))
+	s.Empty(state.Token, "should not have a resume token after the receive")
+
+	badToken := httptest.NewRecorder()
+	downloadClient.DoRaw(&imagestore.SnapshotDownloadRequest{Token: "asdf"}, badToken)
+	s.Equal(http.StatusBadRequest, badToken.Code, "should reject an invalid token")
+
+	// Abort an interrupted upload
+	dest = filepath.Join("guests", uuid.New())
+	s.NotEqual(http.StatusOK, upload(dest, partial), "should fail to receive a partial stream")
+	s.NoError(s.Client.Do("ImageStore.AbortReceive", &imagestore.ReceiveStateRequest{ID: dest}, state))
+	s.Error(s.Client.Do("ImageStore.GetReceiveState", &imagestore.ReceiveStateRequest{ID: dest}, state), "should remove the partially received dataset")
+	s.Error(s.Client.Do("ImageStore.AbortReceive", &imagestore.ReceiveStateRequest{ID: "asdf"}, state), "should need a partial receive")
+}
@@ -0,0 +1,446 @@
+package imagestore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// emptyPayloadHash is the sha256 of an empty request body, used when signing
+// s3 requests
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type (
+	// imageSource retrieves image files, and their checksums and signatures,
+	// from a location
+	imageSource interface {
+		// open opens the file at a location for reading from offset. If the
+		// file doesn't match the validator of the earlier partial read, it is
+		// opened from the start instead.
+		open(location string, offset int64, validator string, cancel chan struct{}) (*sourceFile, error)
+	}
+
+	// sourceFile is a file being read from an image source
+	sourceFile struct {
+		io.ReadCloser
+		offset    int64  // where in the file reading starts
+		size      int64  // total size of the file, -1 if unknown
+		validator string // identifies this version of the file, empty if reads can't be resumed
+		checksum  string // expected checksum, if the source provides one with the file
+		// compression format the source claims the file has, if any
+		compression string
+	}
+
+	// httpSource reads files from http and https urls
+	httpSource struct {
+		client *http.Client
+		// authorize adds credentials to each request before it is sent, if
+		// set
+		authorize func(*http.Request)
+	}
+
+	// fileSource reads files from file urls, which may be on network mounts
+	fileSource struct{}
+
+	// s3Source reads files from s3 urls of the form s3://bucket/key using an
+	// s3 compatible object store
+	s3Source struct {
+		httpSource
+		endpoint  *url.URL
+		region    string
+		accessKey string
+		secretKey string
+	}
+)
+
+// isNotFound determines whether an error from an image source means the file
+// doesn't exist
+func isNotFound(err error) bool {
+	if err == ErrNotFound || os.IsNotExist(err) {
+		return true
+	}
+	httpErr, ok := err.(ErrorHTTPCode)
+	return ok && httpErr.Code == http.StatusNotFound
+}
+
+// newSources creates the image sources for the supported url schemes
+func newSources(config Config) (map[string]imageSource, error) {
+	client, err := newHTTPClient(config.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	authorize, err := config.HTTP.authorizer()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &httpSource{
+		client:    client,
+		authorize: authorize,
+	}
+	sources := map[string]imageSource{
+		"http":  h,
+		"https": h,
+		"file":  fileSource{},
+	}
+
+	if config.S3Endpoint != "" {
+		endpoint, err := url.Parse(config.S3Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		region := config.S3Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		s := &s3Source{
+			httpSource: httpSource{client: client},
+			endpoint:   endpoint,
+			region:     region,
+			accessKey:  config.S3AccessKey,
+			secretKey:  config.S3SecretKey,
+		}
+		// Anonymous access to public buckets doesn't need signing
+		if s.accessKey != "" {
+			s.httpSource.authorize = s.signRequest
+		}
+		sources["s3"] = s
+	}
+	return sources, nil
+}
+
+// sourceLocations determines where to fetch an image from. The source may be
+// the name of a configured source, a url under one of the configured source
+// prefixes, or empty for the image servers. Named sources are url templates
+// where {id} is replaced with the image ID.
+func (store *ImageStore) sourceLocations(id, source string) ([]fetchLocation, error) {
+	if source == "" {
+		locations, err := store.imageServers.locations(id)
+		if err != nil {
+			return nil, err
+		}
+		return append(store.peerLocations(id), locations...), nil
+	}
+
+	if template, ok := store.config.Sources[source]; ok {
+		source = strings.Replace(template, "{id}", url.PathEscape(id), -1)
+	} else if !store.allowedSource(source) {
+		return nil, ErrSourceNotAllowed
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := store.fetcher.sources[u.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported image source: %s", source)
+	}
+
+	checksum, signature := sidecarLocations(source)
+	return []fetchLocation{
+		{
+			source:    source,
+			checksum:  checksum,
+			signature: signature,
+		},
+	}, nil
+}
+
+// allowedSource determines whether a url is under one of the configured source
+// prefixes. Paths with .. in them are never allowed, so they can't climb out
+// of a prefix.
+func (store *ImageStore) allowedSource(source string) bool {
+	u, err := url.Parse(source)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+
+	for _, prefix := range store.config.SourcePrefixes {
+		p, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if u.Scheme != p.Scheme || !strings.EqualFold(u.Host, p.Host) {
+			continue
+		}
+		root := strings.TrimSuffix(p.Path, "/")
+		if u.Path == root || strings.HasPrefix(u.Path, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecarLocations determines where the checksum and signature of an image
+// are. Image servers keep them next to the download endpoint, anywhere else
+// they are expected alongside the image file with .sha256 and .sig extensions.
+func sidecarLocations(location string) (checksum, signature string) {
+	u, err := url.Parse(location)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") && strings.HasSuffix(u.Path, "/download") {
+		base := strings.TrimSuffix(location, "/download")
+		return base + "/checksum", base + "/signature"
+	}
+	return location + ".sha256", location + ".sig"
+}
+
+// sourceFor finds the image source for a location
+func (f *fetcher) sourceFor(location string) (imageSource, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := f.sources[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image source: %s", location)
+	}
+	return source, nil
+}
+
+// readSmall reads the entirety of a small file, such as a checksum or
+// signature, from an image source
+func (f *fetcher) readSmall(location string, limit int64) ([]byte, error) {
+	source, err := f.sourceFor(location)
+	if err != nil {
+		return nil, err
+	}
+	file, err := source.open(location, 0, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"location": location,
+	}, "failed to close source file")
+
+	return ioutil.ReadAll(io.LimitReader(file, limit))
+}
+
+func (h *httpSource) open(location string, offset int64, validator string, cancel chan struct{}) (*sourceFile, error) {
+	httpReq, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.do(httpReq, offset, validator, cancel)
+}
+
+// do sends a request for a file, resuming at offset when possible
+func (h *httpSource) do(httpReq *http.Request, offset int64, validator string, cancel chan struct{}) (*sourceFile, error) {
+	location := httpReq.URL.String()
+	httpReq.Cancel = cancel
+	if offset > 0 && validator != "" {
+		httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		httpReq.Header.Set("If-Range", validator)
+	}
+	if h.authorize != nil {
+		h.authorize(httpReq)
+	}
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &sourceFile{
+		ReadCloser: resp.Body,
+		size:       resp.ContentLength,
+		validator:  responseValidator(resp),
+		checksum:   resp.Header.Get(checksumHeader),
+	}
+	if file.checksum == "" {
+		file.checksum = resp.Header.Get("X-Amz-Meta-Sha256")
+	}
+	file.compression = compressionHint(resp.Header)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err == nil && start != offset {
+			err = fmt.Errorf("resumed read at byte %d, expected %d", start, offset)
+		}
+		if err != nil {
+			logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+			return nil, err
+		}
+		file.offset = offset
+		if file.size >= 0 {
+			file.size += offset
+		}
+		// A partial response may not repeat the validator
+		if file.validator == "" {
+			file.validator = validator
+		}
+	case http.StatusOK:
+	default:
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+		return nil, ErrorHTTPCode{
+			Expected: http.StatusOK,
+			Code:     resp.StatusCode,
+			Source:   location,
+		}
+	}
+	return file, nil
+}
+
+// responseValidator returns the value to use for If-Range when resuming a
+// download of the response. Weak ETags can't be used for range requests.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRangeStart parses the first byte position out of a Content-Range
+// header, e.g. "bytes 100-199/200"
+func contentRangeStart(value string) (int64, error) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, fmt.Errorf("invalid content range: %s", value)
+	}
+	return start, nil
+}
+
+func (fileSource) open(location string, offset int64, validator string, cancel chan struct{}) (*sourceFile, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		logx.LogReturnedErr(file.Close, nil, "failed to close source file")
+		return nil, err
+	}
+
+	// The size and modification time identify the version of a file well
+	// enough for resuming
+	sf := &sourceFile{
+		ReadCloser: file,
+		size:       fi.Size(),
+		validator:  fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano()),
+	}
+	if offset > 0 && validator == sf.validator && offset <= sf.size {
+		if _, err := file.Seek(offset, 0); err != nil {
+			logx.LogReturnedErr(file.Close, nil, "failed to close source file")
+			return nil, err
+		}
+		sf.offset = offset
+	}
+	return sf, nil
+}
+
+func (s *s3Source) open(location string, offset int64, validator string, cancel chan struct{}) (*sourceFile, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use path style requests, which all s3 compatible stores support
+	target := *s.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + u.Host + u.Path
+	httpReq, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(httpReq, offset, validator, cancel)
+}
+
+// signRequest adds an AWS signature version 4 authorization to a request
+func (s *s3Source) signRequest(httpReq *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+
+	httpReq.Header.Set("X-Amz-Date", amzDate)
+	httpReq.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	headers := map[string]string{
+		"host":                 httpReq.URL.Host,
+		"x-amz-content-sha256": emptyPayloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		httpReq.Method,
+		s3EscapePath(httpReq.URL.Path),
+		httpReq.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	httpReq.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath uri encodes each segment of a path the way s3 expects for
+// signing
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		var escaped []byte
+		for _, c := range []byte(segment) {
+			if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				escaped = append(escaped, c)
+			} else {
+				escaped = append(escaped, []byte(fmt.Sprintf("%%%02X", c))...)
+			}
+		}
+		segments[i] = string(escaped)
+	}
+	return strings.Join(segments, "/")
+}
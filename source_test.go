@@ -0,0 +1,122 @@
+package imagestore_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	"github.com/stretchr/testify/suite"
+)
+
+type SourceTestSuite struct {
+	APITestSuite
+	ObjectStore *httptest.Server
+	FileDir     string
+}
+
+func TestSourceTestSuite(t *testing.T) {
+	s := new(SourceTestSuite)
+	s.Configure = s.configure
+	suite.Run(t, s)
+}
+
+func (s *SourceTestSuite) configure(config *imagestore.Config) {
+	var err error
+	s.FileDir, err = ioutil.TempDir("", "SourceTestSuite-")
+	s.Require().NoError(err)
+
+	// Set up a fake s3 compatible object store that only serves signed
+	// requests for objects in the images bucket
+	s.ObjectStore = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/images/"+s.ImageID {
+			if _, err := w.Write(s.ImageData); err != nil {
+				log.WithField("error", err).Error("Failed to write mock image data to response")
+			}
+			return
+		}
+		http.NotFound(w, r)
+	}))
+
+	config.S3Endpoint = s.ObjectStore.URL
+	config.S3AccessKey = "test"
+	config.S3SecretKey = "secret"
+	config.Sources = map[string]string{
+		"mirror": s.ImageService.URL + "/images/{id}/download",
+	}
+	config.SourcePrefixes = []string{
+		"file://" + s.FileDir + "/",
+		"s3://images/",
+		"ftp://example.com/",
+	}
+}
+
+func (s *SourceTestSuite) TearDownSuite() {
+	s.ObjectStore.Close()
+	logx.LogReturnedErr(func() error { return os.RemoveAll(s.FileDir) },
+		nil, "unable to remove dir "+s.FileDir)
+}
+
+func (s *SourceTestSuite) TestRequestImageSources() {
+	filename := filepath.Join(s.FileDir, s.ImageID)
+	s.Require().NoError(ioutil.WriteFile(filename, s.ImageData, 0644))
+
+	tests := []struct {
+		description    string
+		source         string
+		expectedSource string
+		expectedErr    bool
+	}{
+		{"default source",
+			"", s.ImageService.URL + "/images/" + s.ImageID + "/download", false},
+		{"named source",
+			"mirror", s.ImageService.URL + "/images/" + s.ImageID + "/download", false},
+		{"file url",
+			"file://" + filename, "file://" + filename, false},
+		{"missing file",
+			"file://" + filename + "-missing", "", true},
+		{"file outside the prefixes",
+			"file:///etc/passwd", "", true},
+		{"file climbing out of a prefix",
+			"file://" + s.FileDir + "/../" + filepath.Base(s.FileDir) + "/" + s.ImageID, "", true},
+		{"url outside the prefixes",
+			s.ImageService.URL + "/images/" + s.ImageID + "/download", "", true},
+		{"s3 url",
+			"s3://images/" + s.ImageID, "s3://images/" + s.ImageID, false},
+		{"missing s3 object",
+			"s3://images/asdf", "", true},
+		{"unsupported scheme",
+			"ftp://example.com/" + s.ImageID, "", true},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		request := &imagestore.ImageRequest{
+			ImageRequest: rpc.ImageRequest{ID: s.ImageID},
+			Source:       test.source,
+		}
+		response := &imagestore.ImageResponse{}
+		err := s.Client.Do("ImageStore.RequestImage", request, response)
+		if test.expectedErr {
+			s.Error(err, msg("should error"))
+			continue
+		}
+		s.NoError(err, msg("should not error"))
+		s.Len(response.Images, 1, msg("should return the image"))
+		s.Equal(test.expectedSource, response.Images[0].Source, msg("should record the source"))
+
+		// Remove the image so the next source is actually fetched from
+		s.NoError(s.Client.Do("ImageStore.DeleteImage", &rpc.ImageRequest{ID: s.ImageID}, &imagestore.ImageResponse{}), msg("should delete"))
+	}
+}
@@ -1,9 +1,5 @@
 package imagestore
 
-// TODO:
-// - Add a job to cleanup any failed download attempts
-// - Add a job to compare disk to metadata, remove any metadata that has no dataset - the opposite is harder
-
 import (
 	"errors"
 	"fmt"
@@ -13,7 +9,9 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/kvite"
 	"github.com/mistifyio/mistify-agent/client"
 	"github.com/mistifyio/mistify-agent/rpc"
@@ -44,6 +42,24 @@ var (
 	ErrNotSnapshot = errors.New("not a snapshot")
 	// ErrNotValid is an error when the resouce is expected to be a dataset and isn't
 	ErrNotValid = errors.New("not a valid dataset")
+	// ErrNotReady is an error when an image is used before it has been fetched
+	ErrNotReady = errors.New("image not ready")
+	// ErrCanceled is an error when an image fetch is canceled
+	ErrCanceled = errors.New("image fetch canceled")
+	// ErrBaseNotFound is an error when the base of an incremental stream doesn't exist
+	ErrBaseNotFound = errors.New("base snapshot not found")
+	// ErrNotAncestor is an error when the base of an incremental stream isn't an ancestor of the snapshot
+	ErrNotAncestor = errors.New("base is not an ancestor of the snapshot")
+	// ErrBookmarkIntermediate is an error when an intermediate stream is requested from a bookmark
+	ErrBookmarkIntermediate = errors.New("intermediate streams need a base snapshot, not a bookmark")
+	// ErrSourceNotAllowed is an error when an image request names a source that isn't configured
+	ErrSourceNotAllowed = errors.New("image source not allowed")
+	// ErrInvalidImportMode is an error when an import mode isn't one of the import modes
+	ErrInvalidImportMode = errors.New("invalid import mode")
+	// ErrStreamNotVerified is an error when a streamed import is requested from a store with a trust store
+	ErrStreamNotVerified = errors.New("streamed imports aren't verified before they are received, use the staged import mode")
+	// ErrNoPeerChecksum is an error when there's no checksum to verify a peer's copy of an image with
+	ErrNoPeerChecksum = errors.New("no checksum to verify the peer's copy of the image with")
 )
 
 type (
@@ -60,8 +76,27 @@ type (
 		timeToDie chan struct{}
 		// root of the image store
 		dataset string
-		DB      *kvite.DB
-		tempDir string
+		// parent of the temporary clones of disk exports
+		exportDataset string
+		exports       *exportTracker
+		DB            *kvite.DB
+		tempDir       string
+		// keys images must be signed with, if configured
+		trustStore *trustStore
+		// image servers and their health
+		imageServers *serverPool
+		// peer agents and their health
+		peers *serverPool
+		// guest disk migrations to peer agents
+		migrations *migrationTracker
+		// garbage collector of least recently used images
+		collector *collector
+		// reconciles image records with datasets
+		reconciler *reconciler
+		// hashes the send streams of images peers ask for
+		sendHasher *sendHasher
+		// serializes writes of image metadata
+		imageLocks *imageLocks
 	}
 
 	// Config contains configuration for the ImageStore
@@ -70,21 +105,86 @@ type (
 		NumFetchers uint   // workers to use for fetching images
 		MaxPending  uint   // maximum number of queued fetch image
 		Zpool       string
+		TrustStore  string // directory of public keys images must be signed with
+		// Image servers to try in order, failing over when one is down.
+		// ImageServer is used if empty.
+		ImageServers []string
+		// Named image sources, as url templates where {id} is replaced with
+		// the image ID, e.g. s3://images/{id}.gz
+		Sources map[string]string
+		// Url prefixes image requests may give sources under in full, e.g.
+		// https://images.example.com/ or file:///mnt/images/. Any other
+		// source has to be one of the named Sources.
+		SourcePrefixes []string
+		// S3 compatible object store for s3:// image sources
+		S3Endpoint  string
+		S3Region    string
+		S3AccessKey string
+		S3SecretKey string
+		// HTTP client settings for fetching images and migrating guest disks
+		HTTP HTTPConfig
+		// How downloads that fail for transient reasons are retried
+		Retry RetryConfig
+		// Download bandwidth limits in bytes per second, for all downloads
+		// together and for each download, 0 for unlimited. They can be
+		// changed at runtime with SetBandwidthLimit.
+		BandwidthLimit      int64
+		FetchBandwidthLimit int64
+		// Default import mode for image requests, ImportModeStaged if empty.
+		// Streamed imports can't be verified before they are received, so
+		// they aren't allowed with a trust store.
+		ImportMode string
+		// Peer agents to fetch images from before the image servers, in
+		// the same forms as ImageServers. Peers serve the zfs send streams
+		// of their images, which aren't signed, so they aren't used when
+		// there's a trust store.
+		Peers []string
+		// How long a new fetch waits for room when MaxPending fetches are
+		// already queued before failing with EAGAIN, 0 to fail right away.
+		// MaxPending of 0 doesn't limit the queue.
+		QueueWait time.Duration
+		// Bytes images may use before least recently used ones are garbage
+		// collected, 0 for unlimited, and how often to check
+		CacheSize  uint64
+		GCInterval time.Duration
+		// How often image records are reconciled with the datasets of the
+		// image store, in addition to at startup
+		ReconcileInterval time.Duration
 	}
 )
 
 // Create creates an image store with the given config
 func Create(config Config) (*ImageStore, error) {
+	switch config.ImportMode {
+	case "", ImportModeStaged:
+	case ImportModeStream:
+		if config.TrustStore != "" {
+			return nil, ErrStreamNotVerified
+		}
+	default:
+		return nil, ErrInvalidImportMode
+	}
+
 	if config.NumFetchers == 0 {
 		config.NumFetchers = uint(runtime.NumCPU())
 	}
 
+	imageServers := config.ImageServers
+	if len(imageServers) == 0 && config.ImageServer != "" {
+		imageServers = []string{config.ImageServer}
+	}
+
 	store := &ImageStore{
 		config:         config,
 		usersCloneChan: make(chan *cloneRequest),
 		timeToDie:      make(chan struct{}),
 		tempDir:        filepath.Join("/", config.Zpool, "images", "temp"),
 		dataset:        filepath.Join(config.Zpool, "images"),
+		exportDataset:  filepath.Join(config.Zpool, "exports"),
+		exports:        newExportTracker(),
+		imageServers:   newServerPool(imageServers),
+		peers:          newServerPool(config.Peers),
+		imageLocks:     newImageLocks(),
 	}
 
 	_, err := zfs.GetDataset(store.dataset)
@@ -111,6 +211,17 @@ func Create(config Config) (*ImageStore, error) {
 		}
 	}
 
+	if _, err := zfs.GetDataset(store.exportDataset); err != nil {
+		if strings.Contains(err.Error(), "dataset does not exist") {
+			_, err := zfs.CreateFilesystem(store.exportDataset, nil)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
 	fi, err := os.Stat(store.tempDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -127,13 +238,33 @@ func Create(config Config) (*ImageStore, error) {
 		}
 	}
 
-	db, err := kvite.Open(filepath.Join("/", config.Zpool, "images", ".images.db"), DBTABLE)
+	store.migrations, err = newMigrationTracker(config.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TrustStore != "" {
+		ts, err := loadTrustStore(config.TrustStore)
+		if err != nil {
+			return nil, err
+		}
+		store.trustStore = ts
+	}
+
+	// Without a database the image records are rebuilt from the datasets
+	dbFilename := filepath.Join("/", config.Zpool, "images", ".images.db")
+	_, err = os.Stat(dbFilename)
+	lostDB := os.IsNotExist(err)
+	db, err := kvite.Open(dbFilename, DBTABLE)
 	if err != nil {
 		return nil, err
 	}
 	store.DB = db
 	err = store.DB.Transaction(func(tx *kvite.Tx) error {
-		_, err := tx.CreateBucketIfNotExists("images")
+		if _, err := tx.CreateBucketIfNotExists("images"); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists("aliases")
 		return err
 	})
 
@@ -141,11 +272,34 @@ func Create(config Config) (*ImageStore, error) {
 		return nil, err
 	}
 
+	if err := store.failInterruptedFetches(); err != nil {
+		return nil, err
+	}
+
 	// start our clone worker
 	store.cloneWorker = newCloneWorker(store)
+	store.collector = newCollector(store, config.CacheSize, config.GCInterval)
 
 	// start the fetcher
-	store.fetcher = newFetcher(store, config.MaxPending, config.NumFetchers)
+	sources, err := newSources(config)
+	if err != nil {
+		return nil, err
+	}
+	store.fetcher = newFetcher(store, sources, config.Retry, config.MaxPending, config.NumFetchers, config.QueueWait)
+	store.fetcher.setBandwidthLimits(config.BandwidthLimit, config.FetchBandwidthLimit)
+
+	if lostDB {
+		if _, err := store.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+	// Anything left out of line is caught by the periodic reconciling, so a
+	// failure doesn't keep the agent from starting
+	if _, err := store.reconcile(false); err != nil {
+		log.WithField("error", err).Error("failed to reconcile images at startup")
+	}
+	store.reconciler = newReconciler(store, config.ReconcileInterval)
+	store.sendHasher = newSendHasher(store)
 
 	return store, nil
 }
@@ -164,16 +318,19 @@ func (store *ImageStore) Destroy() error {
 func (store *ImageStore) Run() {
 	store.cloneWorker.Run()
 	store.fetcher.run()
+	store.collector.Run()
+	store.reconciler.Run()
+	store.sendHasher.Run()
 	q := <-store.timeToDie
 	store.cloneWorker.Exit()
 	store.fetcher.exit()
+	store.collector.Exit()
+	store.reconciler.Exit()
+	store.sendHasher.Exit()
 	logx.LogReturnedErr(store.DB.Close, nil, "failed to close store")
 	store.timeToDie <- q
 }
 
-// TODO: have a background thread to update from datasets?  no images should come through
-// unless they are in the database
-
 // SpaceAvailible returns the available disk space
 // ensure we are not "over-committing" on disk
 func (store *ImageStore) SpaceAvailible() (uint64, error) {
@@ -239,7 +396,14 @@ func (store *ImageStore) VerifyDisks(r *http.Request, request *rpc.GuestRequest,
 			return EINVAL
 		}
 		if disk.Image != "" {
-			image, err := store.getImage(disk.Image)
+			// Guests are created from the image an alias points at now,
+			// even if it is moved later
+			id, err := store.resolveImage(disk.Image)
+			if err != nil {
+				return err
+			}
+			disk.Image = id
+			image, err := store.getReadyImage(disk.Image)
 			if err != nil {
 				return err
 			}
@@ -285,7 +449,7 @@ func (store *ImageStore) CreateGuestDisks(r *http.Request, request *rpc.GuestReq
 		}
 
 		if disk.Image != "" {
-			image, err := store.getImage(disk.Image)
+			image, err := store.getReadyImage(disk.Image)
 			if err != nil {
 				return err
 			}
@@ -297,6 +461,7 @@ func (store *ImageStore) CreateGuestDisks(r *http.Request, request *rpc.GuestReq
 			if err != nil {
 				return err
 			}
+			store.touchImage(image.ID)
 			disk.Source = deviceForDataset(ds)
 		} else {
 			ds, err := zfs.CreateVolume(disk.Volume, disk.Size*1024*1024, defaultZFSOptions)
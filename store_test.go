@@ -1,11 +1,24 @@
 package imagestore_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mistifyio/go-zfs"
+	"github.com/mistifyio/kvite"
+	imagestore "github.com/mistifyio/mistify-agent-image"
 	"github.com/mistifyio/mistify-agent/client"
 	"github.com/mistifyio/mistify-agent/rpc"
 	"github.com/pborman/uuid"
@@ -32,6 +45,27 @@ func (s *StoreTestSuite) TestSpaceAvailible() {
 	s.True(size > sizeAfter)
 }
 
+func (s *StoreTestSuite) TestCreateImportMode() {
+	tests := []struct {
+		description   string
+		importMode    string
+		trustStore    string
+		expectedError error
+	}{
+		{"invalid import mode", "bogus", "", imagestore.ErrInvalidImportMode},
+		{"streamed with a trust store", imagestore.ImportModeStream, "/nonexistent", imagestore.ErrStreamNotVerified},
+	}
+
+	for _, test := range tests {
+		msg := testMsgFunc(test.description)
+		config := s.StoreConfig
+		config.ImportMode = test.importMode
+		config.TrustStore = test.trustStore
+		_, err := imagestore.Create(config)
+		s.Equal(test.expectedError, err, msg("should fail to create the store"))
+	}
+}
+
 func (s *StoreTestSuite) TestVerifyDisks() {
 	s.fetchImage()
 
@@ -164,3 +198,307 @@ func testMsgFunc(prefix string) func(...interface{}) string {
 		}
 	}
 }
+
+// waitForMigration polls the migration of a guest until the pass is done
+func (s *StoreTestSuite) waitForMigration(guestID string) *imagestore.Migration {
+	request := &rpc.GuestRequest{Guest: &client.Guest{ID: guestID}}
+	for i := 0; i < 100; i++ {
+		response := &imagestore.MigrationResponse{}
+		if err := s.Client.Do("ImageStore.GetGuestMigration", request, response); err == nil && response.Migration.Done {
+			return response.Migration
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Fail("timed out waiting for migration of " + guestID)
+	return nil
+}
+
+func (s *StoreTestSuite) TestMigrateGuestDisks() {
+	guestID := uuid.New()
+	request := &rpc.GuestRequest{Guest: &client.Guest{ID: guestID, Disks: []client.Disk{{Size: 10}, {Size: 10}}}}
+	s.NoError(s.Client.Do("ImageStore.CreateGuestDisks", request, &rpc.GuestResponse{}))
+
+	// A peer agent that only records what it's sent, and one that fails
+	var lock sync.Mutex
+	var uploads []url.Values
+	var sizes []int
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		uploads = append(uploads, r.URL.Query())
+		sizes = append(sizes, len(data))
+		lock.Unlock()
+		if r.URL.Path != "/snapshots/upload" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer peer.Close()
+	downPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer downPeer.Close()
+
+	final := &imagestore.MigrateRequest{Guest: &client.Guest{ID: guestID}, Dest: peer.URL, Final: true}
+	s.Error(s.Client.Do("ImageStore.MigrateGuestDisks", final, &imagestore.MigrationResponse{}), "should need an earlier pass")
+	s.Error(s.Client.Do("ImageStore.MigrateGuestDisks", &imagestore.MigrateRequest{Guest: &client.Guest{ID: uuid.New()}, Dest: peer.URL}, &imagestore.MigrationResponse{}), "should need guest disks")
+
+	var snapshotNames []string
+	for _, final := range []bool{false, true} {
+		msg := testMsgFunc(fmt.Sprintf("final %t", final))
+		lock.Lock()
+		uploads, sizes = nil, nil
+		lock.Unlock()
+		response := &imagestore.MigrationResponse{}
+		request := &imagestore.MigrateRequest{Guest: &client.Guest{ID: guestID}, Dest: peer.URL, Final: final}
+		s.NoError(s.Client.Do("ImageStore.MigrateGuestDisks", request, response), msg("should not error"))
+		s.Len(response.Migration.Disks, 2, msg("should migrate every disk"))
+
+		migration := s.waitForMigration(guestID)
+		if !s.NotNil(migration, msg("should finish")) {
+			return
+		}
+		s.Empty(migration.Error, msg("should not fail"))
+		lock.Lock()
+		s.Len(uploads, 2, msg("should upload every disk"))
+		snapshotNames = nil
+		for i, disk := range migration.Disks {
+			s.True(disk.Done, msg("should finish the disk"))
+			s.Equal(uint64(sizes[i]), disk.Sent, msg("should count what was sent"))
+			s.Equal(fmt.Sprintf("guests/%s/disk-%d", guestID, i), uploads[i].Get("id"), msg("should keep the layout"))
+			s.Equal(strconv.FormatBool(final), uploads[i].Get("force"), msg("should force only the final pass"))
+			s.Equal(final, disk.From != "", msg("should be incremental only for the final pass"))
+			if final {
+				s.Equal("migrate-", uploads[i].Get("prune"), msg("should prune the peer's earlier snapshots"))
+			}
+
+			snapshots, err := zfs.Snapshots(disk.Volume)
+			s.NoError(err, msg("should list the snapshots"))
+			if s.Len(snapshots, 1, msg("should prune earlier snapshots")) {
+				s.Equal(disk.Snapshot, snapshots[0].Name, msg("should keep the latest snapshot"))
+			}
+			snapshotNames = append(snapshotNames, disk.Snapshot)
+		}
+		lock.Unlock()
+	}
+
+	// A failed pass leaves only the snapshots of the last good one
+	failed := &imagestore.MigrateRequest{Guest: &client.Guest{ID: guestID}, Dest: downPeer.URL, Final: true}
+	s.NoError(s.Client.Do("ImageStore.MigrateGuestDisks", failed, &imagestore.MigrationResponse{}))
+	migration := s.waitForMigration(guestID)
+	if !s.NotNil(migration, "failed pass should finish") {
+		return
+	}
+	s.NotEmpty(migration.Error, "failed pass should record the error")
+	s.NotEmpty(migration.Disks[0].Error, "failed pass should record the error of the disk")
+	for i, disk := range migration.Disks {
+		snapshots, err := zfs.Snapshots(disk.Volume)
+		s.NoError(err, "should list the snapshots")
+		if s.Len(snapshots, 1, "failed pass should destroy its snapshots") {
+			s.Equal(snapshotNames[i], snapshots[0].Name, "failed pass should keep the last good snapshot")
+		}
+	}
+}
+
+func (s *StoreTestSuite) TestReconcileAdoptKeepsRecord() {
+	request := &rpc.ImageRequest{ID: "gzipID"}
+	s.NoError(s.Client.Do("ImageStore.RequestImage", request, &imagestore.ImageResponse{}))
+	labels := &imagestore.LabelsRequest{ID: "gzipID", Labels: map[string]string{"os": "linux"}}
+	s.NoError(s.Client.Do("ImageStore.SetImageLabels", labels, &imagestore.ImageResponse{}))
+
+	// Mark the record failed, though its datasets are fine
+	s.NoError(s.Store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		v, err := b.Get("gzipID")
+		if err != nil {
+			return err
+		}
+		image := &imagestore.Image{}
+		if err := json.Unmarshal(v, image); err != nil {
+			return err
+		}
+		image.Status = imagestore.ImageStatusFailed
+		image.Error = "failed"
+		v, err = json.Marshal(image)
+		if err != nil {
+			return err
+		}
+		return b.Put("gzipID", v)
+	}))
+
+	response := &imagestore.ReconcileResponse{}
+	s.NoError(s.Client.Do("ImageStore.ReconcileImages", &imagestore.ReconcileRequest{}, response))
+	images := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, images))
+	if s.Len(images.Images, 1) {
+		s.Equal(imagestore.ImageStatusComplete, images.Images[0].Status, "should adopt the datasets")
+		s.Empty(images.Images[0].Error)
+		s.Equal(map[string]string{"os": "linux"}, images.Images[0].Labels, "should keep what only the record has")
+		s.NotEmpty(images.Images[0].History, "should keep the history")
+	}
+}
+
+func (s *StoreTestSuite) TestReconcileImages() {
+	image := s.fetchImage()
+	request := &rpc.ImageRequest{ID: s.ImageID}
+
+	// Lose the record of the image, and leave a temporary file and an export
+	// clone behind
+	s.NoError(s.Store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		return b.Delete(s.ImageID)
+	}))
+	tempFile := filepath.Join("/", s.ID, "images", "temp", "staleID.partial")
+	s.NoError(ioutil.WriteFile(tempFile, []byte("stale"), 0644))
+	old := time.Now().Add(-48 * time.Hour)
+	s.NoError(os.Chtimes(tempFile, old, old))
+	snapshot, err := zfs.GetDataset(image.Snapshot)
+	s.NoError(err)
+	exportClone := filepath.Join(s.ID, "exports", "export-1")
+	_, err = snapshot.Clone(exportClone, nil)
+	s.NoError(err)
+
+	response := &imagestore.ReconcileResponse{}
+	s.NoError(s.Client.Do("ImageStore.ReconcileImages", &imagestore.ReconcileRequest{DryRun: true}, response))
+	s.True(response.DryRun)
+	s.Equal([]*imagestore.ReconcileChange{
+		{Action: imagestore.ReconcileAdopt, ID: s.ImageID, Name: image.Volume},
+		{Action: imagestore.ReconcileRemoveTemp, ID: "staleID", Name: tempFile},
+		{Action: imagestore.ReconcileRemoveExport, Name: exportClone},
+	}, response.Changes, "should report the changes")
+	s.Error(s.Client.Do("ImageStore.GetImage", request, &imagestore.ImageResponse{}), "should not adopt on a dry run")
+	_, err = os.Stat(tempFile)
+	s.NoError(err, "should not remove files on a dry run")
+
+	s.NoError(s.Client.Do("ImageStore.ReconcileImages", &imagestore.ReconcileRequest{}, response))
+	s.Len(response.Changes, 3)
+	images := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, images), "should adopt the image")
+	if s.Len(images.Images, 1) {
+		s.Equal(imagestore.ImageStatusComplete, images.Images[0].Status)
+		s.Equal(image.Snapshot, images.Images[0].Snapshot)
+	}
+	_, err = os.Stat(tempFile)
+	s.True(os.IsNotExist(err), "should remove the stale file")
+	_, err = zfs.GetDataset(exportClone)
+	s.Error(err, "should destroy the export clone")
+
+	// Lose the datasets of the image
+	volume, err := zfs.GetDataset(image.Volume)
+	s.NoError(err)
+	s.NoError(volume.Destroy(zfs.DestroyRecursive))
+
+	s.NoError(s.Client.Do("ImageStore.ReconcileImages", &imagestore.ReconcileRequest{}, response))
+	s.Equal([]*imagestore.ReconcileChange{
+		{Action: imagestore.ReconcileMissing, ID: s.ImageID, Name: image.Volume},
+	}, response.Changes)
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, images))
+	if s.Len(images.Images, 1) {
+		s.Equal(imagestore.ImageStatusMissing, images.Images[0].Status, "should mark the image missing")
+	}
+}
+
+func (s *StoreTestSuite) TestRebuildImages() {
+	s.fetchImage()
+	request := &rpc.ImageRequest{ID: s.ImageID}
+	fetched := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, fetched))
+	if !s.Len(fetched.Images, 1) {
+		return
+	}
+	image := fetched.Images[0]
+
+	volume, err := zfs.GetDataset(image.Volume)
+	if s.NoError(err) {
+		checksum, err := volume.GetProperty("mistify:checksum")
+		s.NoError(err)
+		s.Equal(image.Checksum, checksum, "should keep the checksum on the volume")
+	}
+
+	// Pin and label the image, which are kept on the volume too
+	s.NoError(s.Client.Do("ImageStore.PinImage", request, &imagestore.ImageResponse{}))
+	labels := &imagestore.LabelsRequest{ID: s.ImageID, Labels: map[string]string{"os": "linux"}}
+	s.NoError(s.Client.Do("ImageStore.SetImageLabels", labels, &imagestore.ImageResponse{}))
+
+	// Lose the properties, like a volume fetched before they were kept
+	s.NoError(exec.Command("zfs", "inherit", "mistify:image-id", image.Volume).Run())
+	response := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.RebuildImages", &imagestore.RebuildRequest{}, response))
+	s.Len(response.Images, 1, "should keep the record of a volume without properties")
+
+	// Lose all records
+	s.NoError(s.Store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		return b.Delete(s.ImageID)
+	}))
+
+	s.NoError(s.Client.Do("ImageStore.RebuildImages", &imagestore.RebuildRequest{}, response))
+	s.Len(response.Images, 1, "should rebuild the image record")
+
+	rebuilt := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, rebuilt))
+	if s.Len(rebuilt.Images, 1) {
+		s.Equal(imagestore.ImageStatusComplete, rebuilt.Images[0].Status)
+		s.Equal(image.Snapshot, rebuilt.Images[0].Snapshot)
+		s.Equal(image.Checksum, rebuilt.Images[0].Checksum)
+		s.Equal(image.Source, rebuilt.Images[0].Source)
+		s.Equal(image.Fetched.Unix(), rebuilt.Images[0].Fetched.Unix())
+		s.True(rebuilt.Images[0].Pinned, "should keep the image pinned")
+		s.Equal(labels.Labels, rebuilt.Images[0].Labels, "should keep the labels")
+	}
+}
+
+func (s *StoreTestSuite) TestRebuildImagesClearedField() {
+	s.fetchImage()
+	request := &rpc.ImageRequest{ID: s.ImageID}
+
+	// Clear the mirror of the record, then update the image so its
+	// properties are saved again
+	s.NoError(s.Store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		v, err := b.Get(s.ImageID)
+		if err != nil {
+			return err
+		}
+		image := &imagestore.Image{}
+		if err := json.Unmarshal(v, image); err != nil {
+			return err
+		}
+		s.NotEmpty(image.Mirror, "should record the mirror the image was fetched from")
+		image.Mirror = ""
+		v, err = json.Marshal(image)
+		if err != nil {
+			return err
+		}
+		return b.Put(s.ImageID, v)
+	}))
+	s.NoError(s.Client.Do("ImageStore.PinImage", request, &imagestore.ImageResponse{}))
+
+	// Lose the record and rebuild it from the properties
+	s.NoError(s.Store.DB.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("images")
+		if err != nil {
+			return err
+		}
+		return b.Delete(s.ImageID)
+	}))
+	s.NoError(s.Client.Do("ImageStore.RebuildImages", &imagestore.RebuildRequest{}, &imagestore.ImageResponse{}))
+
+	rebuilt := &imagestore.ImageResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetImage", request, rebuilt))
+	if s.Len(rebuilt.Images, 1) {
+		s.True(rebuilt.Images[0].Pinned, "should keep the image pinned")
+		s.Empty(rebuilt.Images[0].Mirror, "should not bring back the cleared mirror")
+	}
+}
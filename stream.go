@@ -0,0 +1,200 @@
+package imagestore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/go-zfs"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+)
+
+// Import modes. Staged imports download the whole image to the temp dir
+// before receiving it, so interrupted downloads can be resumed. Streamed
+// imports receive the image as it is downloaded, which needs no space for the
+// download, but start over if interrupted.
+const (
+	ImportModeStaged = "staged"
+	ImportModeStream = "stream"
+)
+
+// errorReader remembers the first error reading, which would otherwise be
+// hidden behind the error of whatever consumed the reader
+type errorReader struct {
+	reader io.Reader
+	err    error
+}
+
+// Read reads from the underlying reader and keeps any error other than EOF
+func (e *errorReader) Read(b []byte) (int, error) {
+	n, err := e.reader.Read(b)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// streamImage downloads an image straight into zfs, with the same failover
+// and retries as a staged download
+func (f *fetcher) streamImage(req *fetchRequest) *fetchResponse {
+	var fetchResp *fetchResponse
+	var checksum, keyID string
+	_, err := f.downloadWithRetry(req, func() (string, error) {
+		var err error
+		fetchResp, checksum, keyID, err = f.streamFrom(req)
+		return checksum, err
+	})
+	if err != nil {
+		if _, ok := err.(ErrorRejected); ok {
+			f.reject(req, checksum, err)
+		}
+		return &fetchResponse{err: err}
+	}
+
+	f.complete(req, fetchResp, checksum, keyID)
+	return fetchResp
+}
+
+// streamFrom receives an image from the current location into zfs as it is
+// downloaded. The checksum and signature can only be verified once the image
+// has been received, so a received image that fails verification is
+// destroyed, as is a partially received one. It returns the checksum of the
+// download and the ID of the key that signed it.
+func (f *fetcher) streamFrom(req *fetchRequest) (*fetchResponse, string, string, error) {
+	source, err := f.sourceFor(req.source)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// Don't bother downloading an image that has no signature to verify
+	var signature []byte
+	if f.store.trustStore != nil {
+		signature, err = f.fetchSignature(req.signatureSource)
+		if err == ErrNoSignature {
+			return nil, "", "", ErrorRejected{
+				ID:     req.name,
+				Reason: err,
+			}
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	file, err := source.open(req.source, 0, "", req.cancel)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"source": req.source,
+	}, "failed to close source file")
+
+	expected, err := f.expectedChecksum(req, file.checksum)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	progress := f.newProgressWriter(req, 0, file.size)
+	defer progress.save()
+
+	// Hash and check the signature of the image as it is downloaded, before
+	// it is decompressed
+	hash := sha256.New()
+	writers := []io.Writer{hash, progress}
+	var pgp *pgpCheck
+	if signature != nil && isPGPSignature(signature) {
+		pgp = f.store.trustStore.startPGPCheck(signature)
+		writers = append(writers, pgp)
+	}
+	throttled, done := f.throttleDownload(req, &cancelReader{
+		reader: file,
+		cancel: req.cancel,
+	})
+	defer done()
+	downloaded := &errorReader{
+		reader: io.TeeReader(throttled, io.MultiWriter(writers...)),
+	}
+
+	received := false
+	defer func() {
+		if pgp != nil {
+			// Unblocks the check if the download failed partway
+			_, _ = pgp.wait()
+		}
+		if !received {
+			destroyReceived(req)
+		}
+	}()
+
+	decompressed, compression, err := decompress(downloaded, sourceCompression(req.source, file))
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer logx.LogReturnedErr(decompressed.Close, nil, "failed to close decompressor")
+
+	// Disk images need to be read at random, so only send streams can be
+	// received as they are downloaded
+	buffered := bufio.NewReader(decompressed)
+	header, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, "", "", err
+	}
+	if format := detectDiskFormat(header); format != DiskFormatZfs {
+		if format == "" {
+			format = "disk"
+		}
+		return nil, "", "", fmt.Errorf("%s images can't be streamed, use the %s import mode", format, ImportModeStaged)
+	}
+
+	dataset, err := zfs.ReceiveSnapshot(buffered, req.dest)
+	if err == nil {
+		// The stream may be followed by data zfs doesn't need, which is still
+		// part of the checksum
+		_, err = io.Copy(ioutil.Discard, downloaded)
+	}
+	// A failed download is the real reason the receive failed
+	if downloaded.err != nil {
+		err = downloaded.err
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	checksum := checksumPrefix + hex.EncodeToString(hash.Sum(nil))
+	if err := verifyChecksum(req, expected, checksum); err != nil {
+		return nil, "", "", err
+	}
+
+	var keyID string
+	if signature != nil {
+		if pgp != nil {
+			keyID, err = pgp.wait()
+			pgp = nil
+		} else {
+			keyID, err = f.store.trustStore.verifyEd25519(checksum, signature)
+		}
+		if err != nil {
+			return nil, checksum, "", ErrorRejected{
+				ID:     req.name,
+				Reason: err,
+			}
+		}
+	}
+
+	snapshots, err := dataset.Snapshots()
+	if err != nil {
+		return nil, "", "", err
+	}
+	received = true
+
+	return &fetchResponse{
+		dataset:     dataset,
+		snapshot:    snapshots[0],
+		compression: compression,
+		format:      DiskFormatZfs,
+	}, checksum, keyID, nil
+}
@@ -0,0 +1,276 @@
+package imagestore
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most read from a throttled download at once, so waits
+// for bandwidth stay short
+const throttleChunk = 32 * 1024
+
+type (
+	// rateLimiter is a token bucket limiting bytes per second, with a burst of
+	// one second's worth. A limit of 0 is unlimited.
+	rateLimiter struct {
+		lock   sync.Mutex
+		limit  int64
+		tokens float64
+		last   time.Time
+		now    func() time.Time // clock, time.Now if nil
+	}
+
+	// rateMeter measures bytes per second over roughly the last second
+	rateMeter struct {
+		lock  sync.Mutex
+		count int64
+		start time.Time
+		rate  int64
+	}
+
+	// throttle limits and measures the bandwidth of downloads
+	throttle struct {
+		limiter rateLimiter
+		meter   rateMeter
+	}
+
+	// throttledReader reads a download within both the global and its own
+	// bandwidth limits
+	throttledReader struct {
+		reader io.Reader
+		global *throttle
+		fetch  *throttle
+		cancel chan struct{}
+	}
+
+	// BandwidthRequest is the request for SetBandwidthLimit
+	BandwidthRequest struct {
+		Limit      int64 `json:"limit"`      // bytes per second for all downloads, 0 for unlimited
+		FetchLimit int64 `json:"fetchLimit"` // bytes per second for each download, 0 for unlimited
+	}
+
+	// FetchStatsRequest is the request for GetFetchStats
+	FetchStatsRequest struct{}
+
+	// FetchStats is the download bandwidth state of the fetcher. Rates are in
+	// bytes per second.
+	FetchStats struct {
+		Limit      int64            `json:"limit"`
+		FetchLimit int64            `json:"fetchLimit"`
+		Rate       int64            `json:"rate"`
+		Fetches    map[string]int64 `json:"fetches"` // rate of each download by image ID
+	}
+
+	// FetchStatsResponse is the response for fetch stats methods
+	FetchStatsResponse struct {
+		Stats *FetchStats `json:"stats"`
+	}
+)
+
+// newThrottle creates a throttle with a bytes per second limit
+func newThrottle(limit int64) *throttle {
+	t := &throttle{}
+	t.limiter.setLimit(limit)
+	t.meter.start = time.Now()
+	return t
+}
+
+// setLimit changes the bytes per second limit
+func (l *rateLimiter) setLimit(limit int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if limit < 0 {
+		limit = 0
+	}
+	// Bandwidth unused so far counts under the old limit
+	l.refill(l.clock())
+	l.limit = limit
+	if l.tokens > float64(limit) {
+		l.tokens = float64(limit)
+	}
+}
+
+// getLimit returns the bytes per second limit
+func (l *rateLimiter) getLimit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.limit
+}
+
+// clock returns the current time
+func (l *rateLimiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// refill adds the tokens earned since the last refill, up to a second's worth
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// they are within the limit
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limit == 0 {
+		return 0
+	}
+	l.refill(l.clock())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+}
+
+// wait blocks until n bytes are within the limit or the fetch is canceled
+func (l *rateLimiter) wait(n int, cancel chan struct{}) error {
+	delay := l.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-cancel:
+		return ErrCanceled
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// add counts bytes transferred
+func (m *rateMeter) add(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.count += int64(n)
+	m.roll(time.Now())
+}
+
+// getRate returns the bytes per second over roughly the last second
+func (m *rateMeter) getRate() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.roll(time.Now())
+	return m.rate
+}
+
+// roll starts a new measurement once the current one covers a second
+func (m *rateMeter) roll(now time.Time) {
+	elapsed := now.Sub(m.start)
+	if elapsed < time.Second {
+		return
+	}
+	m.rate = int64(float64(m.count) / elapsed.Seconds())
+	m.count = 0
+	m.start = now
+}
+
+// Read reads a chunk and waits until it is within the bandwidth limits
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := t.reader.Read(b)
+	if n > 0 {
+		t.global.meter.add(n)
+		t.fetch.meter.add(n)
+		if err := t.global.limiter.wait(n, t.cancel); err != nil {
+			return n, err
+		}
+		if err := t.fetch.limiter.wait(n, t.cancel); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// throttleDownload limits the bandwidth of a download. The returned function
+// must be called once the download is done.
+func (f *fetcher) throttleDownload(req *fetchRequest, reader io.Reader) (io.Reader, func()) {
+	f.lock.Lock()
+	t := newThrottle(f.fetchLimit)
+	f.throttles[req.name] = t
+	f.lock.Unlock()
+
+	done := func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.throttles[req.name] == t {
+			delete(f.throttles, req.name)
+		}
+	}
+
+	return &throttledReader{
+		reader: reader,
+		global: f.bandwidth,
+		fetch:  t,
+		cancel: req.cancel,
+	}, done
+}
+
+// setBandwidthLimits changes the global and per download limits, including
+// for downloads in progress
+func (f *fetcher) setBandwidthLimits(limit, fetchLimit int64) {
+	f.bandwidth.limiter.setLimit(limit)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fetchLimit = fetchLimit
+	for _, t := range f.throttles {
+		t.limiter.setLimit(fetchLimit)
+	}
+}
+
+// stats returns the current bandwidth state
+func (f *fetcher) stats() *FetchStats {
+	stats := &FetchStats{
+		Limit:   f.bandwidth.limiter.getLimit(),
+		Rate:    f.bandwidth.meter.getRate(),
+		Fetches: make(map[string]int64),
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	stats.FetchLimit = f.fetchLimit
+	for name, t := range f.throttles {
+		stats.Fetches[name] = t.meter.getRate()
+	}
+	return stats
+}
+
+// SetBandwidthLimit changes the download bandwidth limits. They apply to
+// downloads already in progress.
+func (store *ImageStore) SetBandwidthLimit(r *http.Request, request *BandwidthRequest, response *FetchStatsResponse) error {
+	if request.Limit < 0 || request.FetchLimit < 0 {
+		return errors.New("limits can't be negative")
+	}
+
+	store.fetcher.setBandwidthLimits(request.Limit, request.FetchLimit)
+
+	*response = FetchStatsResponse{
+		Stats: store.fetcher.stats(),
+	}
+	return nil
+}
+
+// GetFetchStats retrieves the download bandwidth limits and current rates
+func (store *ImageStore) GetFetchStats(r *http.Request, request *FetchStatsRequest, response *FetchStatsResponse) error {
+	*response = FetchStatsResponse{
+		Stats: store.fetcher.stats(),
+	}
+	return nil
+}
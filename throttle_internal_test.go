@@ -0,0 +1,33 @@
+package imagestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &rateLimiter{now: func() time.Time { return now }}
+	assert.Equal(t, time.Duration(0), l.reserve(1<<20), "unlimited should never wait")
+
+	l.setLimit(1000)
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve(1000), "burst should not wait")
+	assert.Equal(t, 500*time.Millisecond, l.reserve(500), "should wait for the bytes past the burst")
+
+	// A second refills the deficit and half the bucket
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve(500))
+
+	// The bucket never holds more than a second's worth
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Second, l.reserve(2000))
+
+	// Lowering the limit drops tokens over the new limit
+	now = now.Add(time.Hour)
+	l.setLimit(100)
+	assert.Equal(t, time.Duration(0), l.reserve(100))
+	assert.Equal(t, time.Second, l.reserve(100))
+}
@@ -0,0 +1,46 @@
+package imagestore_test
+
+import (
+	"testing"
+	"time"
+
+	imagestore "github.com/mistifyio/mistify-agent-image"
+	"github.com/mistifyio/mistify-agent/rpc"
+	"github.com/stretchr/testify/suite"
+)
+
+type ThrottleTestSuite struct {
+	APITestSuite
+}
+
+func TestThrottleTestSuite(t *testing.T) {
+	suite.Run(t, new(ThrottleTestSuite))
+}
+
+func (s *ThrottleTestSuite) TestSetBandwidthLimit() {
+	response := &imagestore.FetchStatsResponse{}
+	s.Error(s.Client.Do("ImageStore.SetBandwidthLimit", &imagestore.BandwidthRequest{Limit: -1}, response), "negative limit should error")
+
+	request := &imagestore.BandwidthRequest{
+		Limit:      1024 * 1024,
+		FetchLimit: int64(len(s.ImageData) / 2),
+	}
+	s.NoError(s.Client.Do("ImageStore.SetBandwidthLimit", request, response))
+	s.Equal(request.Limit, response.Stats.Limit)
+	s.Equal(request.FetchLimit, response.Stats.FetchLimit)
+
+	response = &imagestore.FetchStatsResponse{}
+	s.NoError(s.Client.Do("ImageStore.GetFetchStats", &imagestore.FetchStatsRequest{}, response))
+	s.Equal(request.Limit, response.Stats.Limit)
+	s.Equal(request.FetchLimit, response.Stats.FetchLimit)
+	s.Empty(response.Stats.Fetches)
+
+	// The limiter starts with an empty bucket, so at half the image a
+	// second the download takes about two seconds. The bounds leave plenty
+	// of room for a slow machine.
+	start := time.Now()
+	s.NoError(s.Client.Do("ImageStore.RequestImage", &rpc.ImageRequest{ID: s.ImageID}, &imagestore.ImageResponse{}), "throttled download should complete")
+	elapsed := time.Since(start)
+	s.True(elapsed >= 500*time.Millisecond, "download should be throttled")
+	s.True(elapsed < 30*time.Second, "download should not be throttled past the limit")
+}
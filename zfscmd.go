@@ -0,0 +1,44 @@
+package imagestore
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/mistifyio/go-zfs.v1"
+)
+
+// zfsCommand runs a zfs command go-zfs has no support for. Failures are
+// returned as zfs.Errors so they can be checked like go-zfs errors.
+func zfsCommand(stdin io.Reader, stdout io.Writer, arg ...string) error {
+	cmd := exec.Command("zfs", arg...)
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return &zfs.Error{
+			Err:    err,
+			Debug:  strings.Join(append([]string{cmd.Path}, arg...), " "),
+			Stderr: stderr.String(),
+		}
+	}
+	return nil
+}
+
+// zfsProperties gets properties of a dataset, snapshot or bookmark
+func zfsProperties(name string, properties ...string) (map[string]string, error) {
+	var out bytes.Buffer
+	if err := zfsCommand(nil, &out, "get", "-Hp", "-o", "property,value", strings.Join(properties, ","), name); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(properties))
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			values[fields[0]] = fields[1]
+		}
+	}
+	return values, nil
+}